@@ -0,0 +1,88 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiToken is the payload of an API token.
+type apiToken struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Expiry        int64  `json:"exp"`
+}
+
+var errNoSecret = errors.New("no secret; set Config.Secret")
+
+// APIToken returns a short-lived token for API calls, signed with
+// Config.Secret, after verifying the id token cookie.
+// Unlike the session cookie, it is meant to be sent to APIs as bearer token,
+// which verify it with VerifyAPIToken.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) APIToken(r *http.Request) (string, error) {
+	if s.secret == nil {
+		return "", errNoSecret
+	}
+	id, err := s.Identity(r)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(&apiToken{
+		Issuer:        id.Issuer,
+		Subject:       id.Subject,
+		Audience:      s.apiAudience,
+		Email:         id.Email,
+		EmailVerified: id.EmailVerified,
+		Expiry:        s.now().Add(s.apiTokenDuration).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(s.mac("api", p)), nil
+}
+
+// VerifyAPIToken verifies a token returned by APIToken for Config.APIAudience
+// and returns the identity.
+func (s *Auth) VerifyAPIToken(token string) (Identity, error) {
+	if s.secret == nil {
+		return Identity{}, errNoSecret
+	}
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Identity{}, errors.New("malformed API token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac("api", p)) {
+		return Identity{}, errors.New("invalid API token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return Identity{}, fmt.Errorf("malformed API token: %v", err)
+	}
+	var t apiToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return Identity{}, fmt.Errorf("malformed API token: %v", err)
+	}
+	if s.now().After(time.Unix(t.Expiry, 0)) {
+		return Identity{}, errors.New("API token expired")
+	}
+	if t.Audience != s.apiAudience {
+		return Identity{}, fmt.Errorf("%w: API token for %q", ErrAudienceMismatch, t.Audience)
+	}
+	return Identity{
+		Issuer:        t.Issuer,
+		Subject:       t.Subject,
+		Email:         t.Email,
+		EmailVerified: t.EmailVerified,
+	}, nil
+}
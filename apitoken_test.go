@@ -0,0 +1,37 @@
+package openid
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	secret := []byte("secret")
+	auth := newTestAuth(t, srv, &Config{Secret: secret, AllowUnverifiedEmail: true})
+	other := newTestAuth(t, srv, &Config{Secret: secret, ClientID: "other"})
+
+	for _, verified := range []bool{true, false} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: auth.tokenCookie, Value: sign(map[string]interface{}{"email_verified": verified})})
+		token, err := auth.APIToken(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := auth.VerifyAPIToken(token)
+		if err != nil {
+			t.Fatalf("VerifyAPIToken: %v", err)
+		}
+		if id.Subject != "123" || id.EmailVerified != verified {
+			t.Errorf("VerifyAPIToken: got %+v, want subject 123 and email verified %v", id, verified)
+		}
+		if _, err := other.VerifyAPIToken(token); !errors.Is(err, ErrAudienceMismatch) {
+			t.Errorf("VerifyAPIToken of another audience: got %v, want %v", err, ErrAudienceMismatch)
+		}
+		if _, err := auth.VerifyAPIToken(token + "x"); err == nil {
+			t.Error("VerifyAPIToken of a tampered token: got nil error")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package openid
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errClosed = errors.New("closed")
+
+// background runs goroutines until Close.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// run runs f in a goroutine, with the values of parent but canceled only by
+// close. It returns false if closed.
+func (b *background) run(parent context.Context, f func(ctx context.Context)) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stop := context.AfterFunc(b.ctx, cancel)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer stop()
+		defer cancel()
+		f(ctx)
+	}()
+	return true
+}
+
+// close stops the goroutines and waits for them.
+func (b *background) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cancel()
+	b.wg.Wait()
+}
+
+// Close stops the background goroutines, e.g. key fetches, and waits for
+// them. The handlers remain registered but should no longer be used.
+func (s *Auth) Close() error {
+	s.bg.close()
+	return nil
+}
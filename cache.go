@@ -0,0 +1,154 @@
+package openid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// cache stores the provider metadata and keys on disk, see Config.CacheDir.
+type cache struct {
+	dir  string
+	name string // of the provider, so that providers can share the directory
+}
+
+func newCache(dir, provider string) *cache {
+	h := sha256.Sum256([]byte(provider))
+	return &cache{dir: dir, name: hex.EncodeToString(h[:8])}
+}
+
+func (c *cache) path(kind string) string {
+	return filepath.Join(c.dir, c.name+"."+kind+".json")
+}
+
+func (c *cache) load(kind string) ([]byte, error) {
+	return os.ReadFile(c.path(kind))
+}
+
+// store writes atomically, so that a concurrent load never sees a partial file.
+func (c *cache) store(kind string, b []byte) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, c.name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(kind))
+}
+
+// discoverCached is like discover but prefers the cached metadata, and
+// reports whether it was cached so that it is refreshed in the background.
+func discoverCached(ctx context.Context, provider, issuer string, c *cache) (*oidc.Provider, *metadata, bool, error) {
+	if raw, err := c.load("discovery"); err == nil {
+		p, meta, err := providerFromJSON(ctx, issuer, raw)
+		if err == nil {
+			return p, meta, true, nil
+		}
+		log.Printf("openid: ignoring cached discovery: %v", err)
+	}
+	p, meta, err := discover(ctx, provider, issuer)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	c.storeDiscovery(p)
+	return p, meta, false, nil
+}
+
+// providerFromJSON creates a provider from its metadata, checking its issuer
+// is the expected one, if any.
+func providerFromJSON(ctx context.Context, issuer string, raw []byte) (*oidc.Provider, *metadata, error) {
+	var meta metadata
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, err
+	}
+	if err := checkIssuer(issuer, meta.Issuer); err != nil {
+		return nil, nil, err
+	}
+	var endpoints struct {
+		AuthURL       string `json:"authorization_endpoint"`
+		TokenURL      string `json:"token_endpoint"`
+		DeviceAuthURL string `json:"device_authorization_endpoint"`
+		UserInfoURL   string `json:"userinfo_endpoint"`
+	}
+	if err := json.Unmarshal(raw, &endpoints); err != nil {
+		return nil, nil, err
+	}
+	config := &oidc.ProviderConfig{
+		IssuerURL:     meta.Issuer,
+		AuthURL:       endpoints.AuthURL,
+		TokenURL:      endpoints.TokenURL,
+		DeviceAuthURL: endpoints.DeviceAuthURL,
+		UserInfoURL:   endpoints.UserInfoURL,
+		JWKSURL:       meta.JWKSURL,
+		Algorithms:    meta.Algorithms,
+	}
+	return config.NewProvider(ctx), &meta, nil
+}
+
+func (c *cache) storeDiscovery(p *oidc.Provider) {
+	var raw json.RawMessage
+	if err := p.Claims(&raw); err != nil {
+		log.Printf("openid: caching discovery: %v", err)
+		return
+	}
+	if err := c.store("discovery", raw); err != nil {
+		log.Printf("openid: caching discovery: %v", err)
+	}
+}
+
+func (c *cache) loadKeys() []jose.JSONWebKey {
+	b, err := c.load("keys")
+	if err != nil {
+		return nil
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &keySet); err != nil {
+		log.Printf("openid: ignoring cached keys: %v", err)
+		return nil
+	}
+	return keySet.Keys
+}
+
+func (c *cache) storeKeys(keys []jose.JSONWebKey) {
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	if err == nil {
+		err = c.store("keys", b)
+	}
+	if err != nil {
+		log.Printf("openid: caching keys: %v", err)
+	}
+}
+
+// refreshCache discovers the provider and fetches the keys again, to update
+// the cache after a start from it. The running module keeps the metadata it
+// started with, so a change is logged to restart.
+func (s *Auth) refreshCache(ctx context.Context, provider, issuer string, c *cache) {
+	p, meta, err := discover(ctx, provider, issuer)
+	if err != nil {
+		log.Printf("openid: refreshing cached discovery: %v", err)
+	} else {
+		c.storeDiscovery(p)
+		if p.Endpoint() != s.provider.Endpoint() || meta.JWKSURL != s.keys.url || meta.EndSessionURL != s.endSessionURL {
+			log.Print("openid: provider metadata changed since cached, restart to use it")
+		}
+	}
+	if _, err := s.keys.refresh(ctx); err != nil {
+		log.Printf("openid: refreshing cached keys: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package openid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// newProviderAuth creates an auth module with NewWithProvider, and returns a
+// function to sign tokens for it.
+func newProviderAuth(t *testing.T) (*Auth, signFunc) {
+	srv, sign := newSigningProvider(t)
+	ctx := oidc.ClientContext(context.Background(), srv.Client())
+	p, err := oidc.NewProvider(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewWithProvider(ctx, "client", p)
+	t.Cleanup(func() { auth.Close() })
+	return auth, sign
+}
+
+func TestNewWithProvider(t *testing.T) {
+	auth, sign := newProviderAuth(t)
+	idToken, err := auth.VerifyToken(context.Background(), sign(nil))
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if idToken.Subject != "123" {
+		t.Errorf("VerifyToken: got subject %q, want 123", idToken.Subject)
+	}
+	if _, err := auth.VerifyToken(context.Background(), sign(map[string]interface{}{"aud": "other"})); err == nil {
+		t.Error("VerifyToken of another audience: got nil error")
+	}
+}
+
+func TestVerifyCodeHash(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{})
+	sum := sha256.Sum256([]byte("code"))
+	cHash := base64.RawURLEncoding.EncodeToString(sum[:16])
+	for _, tt := range []struct {
+		name  string
+		cHash interface{}
+		code  string
+		ok    bool
+	}{
+		{name: "valid", cHash: cHash, code: "code", ok: true},
+		{name: "other code", cHash: cHash, code: "other"},
+		{name: "missing", code: "code"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			token := sign(map[string]interface{}{"c_hash": tt.cHash})
+			idToken, err := auth.VerifyToken(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyCodeHash(token, tt.code, idToken); (err == nil) != tt.ok {
+				t.Errorf("verifyCodeHash: got %v", err)
+			}
+		})
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/page?a=1", true},
+		{"", false},
+		{"page", false},
+		{"//evil.example/", false},
+		{"/\\evil.example/", false},
+		{"https://evil.example/", false},
+	} {
+		if got := isLocalPath(tt.path); got != tt.want {
+			t.Errorf("isLocalPath(%q): got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// withCookies returns a request with the cookies set by a response.
+func withCookies(target string, w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestVerifyNonce(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	for _, tt := range []struct {
+		name   string
+		config Config
+		// token returns the nonce of the token for the nonce cookie.
+		token   func(cookie string) string
+		host    string // of the callback, defaults to that of the redirect
+		wantErr error  // nil for any error
+		ok      bool
+	}{
+		{name: "valid", token: func(c string) string { return c }, ok: true},
+		{name: "other", token: func(string) string { return randomNonce() }},
+		{name: "malformed", token: func(string) string { return "nonce" }, wantErr: ErrMalformedNonce},
+		{name: "bound", config: Config{Secret: []byte("secret")}, token: func(c string) string { return c }, ok: true},
+		{name: "bound to other redirect URI", config: Config{Secret: []byte("secret")}, token: func(c string) string { return c }, host: "other.example"},
+		{name: "unbound with secret", config: Config{Secret: []byte("secret")}, token: func(c string) string {
+			n, _, _ := strings.Cut(c, ".")
+			return n
+		}, wantErr: ErrMalformedNonce},
+		{name: "hashed", config: Config{HashedNonce: true}, token: func(c string) string {
+			sum := sha256.Sum256([]byte(c))
+			return hex.EncodeToString(sum[:])
+		}, ok: true},
+		{name: "hashed base64url", config: Config{HashedNonce: true}, token: func(c string) string {
+			sum := sha256.Sum256([]byte(c))
+			return base64.RawURLEncoding.EncodeToString(sum[:])
+		}, ok: true},
+		{name: "hash without HashedNonce", token: func(c string) string {
+			sum := sha256.Sum256([]byte(c))
+			return hex.EncodeToString(sum[:])
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			auth := newTestAuth(t, srv, &c)
+			w := httptest.NewRecorder()
+			auth.Redirect(w, httptest.NewRequest("GET", "https://app.example/page", nil))
+			host := "app.example"
+			if tt.host != "" {
+				host = tt.host
+			}
+			r := withCookies("https://"+host+"/auth/callback", w)
+			cookie, err := r.Cookie(auth.nonceCookie)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idToken, err := auth.VerifyToken(context.Background(), sign(map[string]interface{}{"nonce": tt.token(cookie.Value)}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = auth.verifyNonce(r, url.Values{}, idToken)
+			switch {
+			case tt.ok && err != nil:
+				t.Errorf("verifyNonce: %v", err)
+			case !tt.ok && err == nil:
+				t.Error("verifyNonce: got nil error")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("verifyNonce: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestState(t *testing.T) {
+	auth, _ := newProviderAuth(t)
+	w := httptest.NewRecorder()
+	auth.setState(w, &loginState{Return: "/page", Forget: true})
+	r := withCookies("https://app.example/auth/callback", w)
+	if got := auth.state(r); got.Return != "/page" || !got.Forget {
+		t.Errorf("state: got %+v, want the state set", got)
+	}
+	c, _ := r.Cookie(auth.stateCookie)
+	p, sig, _ := strings.Cut(c.Value, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"r":"https://evil.example/"}`))
+	for _, value := range []string{forged + "." + sig, p + ".", p} {
+		r := httptest.NewRequest("GET", "https://app.example/auth/callback", nil)
+		r.AddCookie(&http.Cookie{Name: auth.stateCookie, Value: value})
+		if got := auth.state(r); *got != (loginState{}) {
+			t.Errorf("state of cookie %q: got %+v, want empty", value, got)
+		}
+	}
+}
+
+func TestLoginReturn(t *testing.T) {
+	auth, _ := newProviderAuth(t)
+	for _, tt := range []struct {
+		ret  string
+		want string
+	}{
+		{"", ""}, // the callback then returns to PostLoginPath
+		{"/page?a=1", "/page?a=1"},
+		{"https://app.example/page?a=1", "/page?a=1"},
+		{"https://evil.example/page", "/"},
+		{"//evil.example/page", "/"},
+		{"http://app.example/page", "/"},
+	} {
+		w := httptest.NewRecorder()
+		auth.login(w, httptest.NewRequest("GET", "https://app.example/auth/login?return="+url.QueryEscape(tt.ret), nil))
+		if got := auth.state(withCookies("https://app.example/auth/callback", w)).Return; got != tt.want {
+			t.Errorf("login with return %q: got return to %q, want %q", tt.ret, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPrompt(t *testing.T) {
+	for _, tt := range []struct {
+		prompt string
+		ok     bool
+	}{
+		{"", true},
+		{"login", true},
+		{"login consent", true},
+		{"select_account", true},
+		{"none", true},
+		{"none login", false},
+		{"other", false},
+	} {
+		if err := checkPrompt(tt.prompt); (err == nil) != tt.ok {
+			t.Errorf("checkPrompt(%q): got %v", tt.prompt, err)
+		}
+	}
+}
+
+func TestExpandProvider(t *testing.T) {
+	for _, tt := range []struct {
+		provider string
+		want     string // empty for an error
+	}{
+		{"https://issuer.example", "https://issuer.example"},
+		{"google", "https://accounts.google.com"},
+		{"microsoft:tenant", "https://login.microsoftonline.com/tenant/v2.0"},
+		{"okta:example.okta.com", "https://example.okta.com"},
+		{"microsoft", ""},
+		{"microsoft:", ""},
+		{"okta:evil.example/path", ""},
+		{"google:param", ""},
+	} {
+		got, err := expandProvider(tt.provider)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("expandProvider(%q): got %q, want an error", tt.provider, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandProvider(%q): got %q, %v; want %q", tt.provider, got, err, tt.want)
+		}
+	}
+}
+
+func TestTokenChunks(t *testing.T) {
+	auth, _ := newProviderAuth(t)
+	for _, size := range []int{10, tokenChunkSize, tokenChunkSize + 1, 3*tokenChunkSize + 10, maxTokenChunks * tokenChunkSize} {
+		value := strings.Repeat("x", size)
+		w := httptest.NewRecorder()
+		if err := auth.setTokenCookie(w, httptest.NewRequest("GET", "/", nil), value, 60); err != nil {
+			t.Fatalf("setTokenCookie of %d bytes: %v", size, err)
+		}
+		for _, c := range w.Result().Cookies() {
+			if len(c.Value) > tokenChunkSize {
+				t.Errorf("setTokenCookie of %d bytes: cookie %v of %d bytes", size, c.Name, len(c.Value))
+			}
+		}
+		if got, err := auth.tokenCookieValue(withCookies("/", w)); err != nil || got != value {
+			t.Errorf("tokenCookieValue of %d bytes: got %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := auth.setTokenCookie(w, httptest.NewRequest("GET", "/", nil), strings.Repeat("x", maxTokenChunks*tokenChunkSize+1), 60); err == nil {
+		t.Error("setTokenCookie of too many chunks: got nil error")
+	}
+
+	// Replacing a chunked token by a small one deletes the chunks.
+	w = httptest.NewRecorder()
+	auth.setTokenCookie(w, httptest.NewRequest("GET", "/", nil), strings.Repeat("x", 2*tokenChunkSize), 60)
+	r := withCookies("/", w)
+	w = httptest.NewRecorder()
+	auth.setTokenCookie(w, r, "small", 60)
+	deleted := map[string]bool{}
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			deleted[c.Name] = true
+		}
+	}
+	if !deleted[auth.tokenChunk(0)] || !deleted[auth.tokenChunk(1)] {
+		t.Errorf("chunks not deleted: %v", w.Result().Header["Set-Cookie"])
+	}
+
+	w = httptest.NewRecorder()
+	auth.deleteTokenCookie(w)
+	if n := len(w.Result().Cookies()); n != 1+maxTokenChunks {
+		t.Errorf("deleteTokenCookie: got %d cookies deleted, want %d", n, 1+maxTokenChunks)
+	}
+}
@@ -0,0 +1,83 @@
+package openid
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tokenChunkSize is the largest token cookie value, within the 4KB limit
+	// of browsers for the name and value of a cookie.
+	tokenChunkSize = 3800
+	// maxTokenChunks limits the number of cookies of a large token, as the
+	// request headers of browsers and servers are limited too.
+	maxTokenChunks = 8
+)
+
+// tokenChunk returns the name of a token cookie chunk.
+func (s *Auth) tokenChunk(i int) string {
+	return s.tokenCookie + "." + strconv.Itoa(i)
+}
+
+// setTokenCookie sets the token cookie, split into numbered chunk cookies if
+// it is too large for one, and deletes those left by a previous value.
+func (s *Auth) setTokenCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) error {
+	if len(value) <= tokenChunkSize {
+		s.setCookie(w, s.tokenCookie, value, maxAge, s.tokenSameSite)
+		s.deleteTokenChunks(w, r, 0)
+		return nil
+	}
+	n := (len(value) + tokenChunkSize - 1) / tokenChunkSize
+	if n > maxTokenChunks {
+		return fmt.Errorf("token too large: %d bytes", len(value))
+	}
+	for i := 0; i < n; i++ {
+		s.setCookie(w, s.tokenChunk(i), value[i*tokenChunkSize:min((i+1)*tokenChunkSize, len(value))], maxAge, s.tokenSameSite)
+	}
+	if _, err := r.Cookie(s.tokenCookie); err == nil {
+		s.deleteCookie(w, s.tokenCookie, s.tokenSameSite)
+	}
+	s.deleteTokenChunks(w, r, n)
+	return nil
+}
+
+// deleteTokenChunks deletes the chunk cookies of the request from the first.
+func (s *Auth) deleteTokenChunks(w http.ResponseWriter, r *http.Request, first int) {
+	for i := first; i < maxTokenChunks; i++ {
+		if _, err := r.Cookie(s.tokenChunk(i)); err != nil {
+			break
+		}
+		s.deleteCookie(w, s.tokenChunk(i), s.tokenSameSite)
+	}
+}
+
+// tokenCookieValue returns the value of the token cookie, reassembled from its
+// chunks if split.
+func (s *Auth) tokenCookieValue(r *http.Request) (string, error) {
+	if c, err := r.Cookie(s.tokenCookie); err == nil {
+		return c.Value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < maxTokenChunks; i++ {
+		c, err := r.Cookie(s.tokenChunk(i))
+		if err != nil {
+			break
+		}
+		b.WriteString(c.Value)
+	}
+	if b.Len() == 0 {
+		return "", http.ErrNoCookie
+	}
+	return b.String(), nil
+}
+
+// deleteTokenCookie deletes the token cookie and all its possible chunks, even
+// those not sent with the request, e.g. SameSite=Strict on logout from a link.
+func (s *Auth) deleteTokenCookie(w http.ResponseWriter) {
+	s.deleteCookie(w, s.tokenCookie, s.tokenSameSite)
+	for i := 0; i < maxTokenChunks; i++ {
+		s.deleteCookie(w, s.tokenChunk(i), s.tokenSameSite)
+	}
+}
@@ -0,0 +1,75 @@
+package openid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// newProvider serves a provider whose keys never come, until the request is
+// canceled or the test ends.
+func newProvider(t *testing.T) *httptest.Server {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	return srv
+}
+
+func TestCloseGoroutines(t *testing.T) {
+	srv := newProvider(t)
+	client := srv.Client()
+	before := runtime.NumGoroutine()
+
+	auth, err := New(context.Background(), &Config{
+		Provider:   srv.URL,
+		ClientID:   "client",
+		HTTPClient: client,
+		Mux:        http.NewServeMux(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := auth.RefreshKeys(ctx); err == nil {
+		t.Fatal("RefreshKeys: got nil error, want timeout")
+	}
+	if err := auth.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := auth.RefreshKeys(ctx); err != errClosed {
+		t.Errorf("RefreshKeys after Close: got %v, want %v", err, errClosed)
+	}
+
+	client.CloseIdleConnections()
+	var after int
+	for i := 0; i < 100; i++ {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<16)
+	t.Errorf("goroutines: %d before, %d after Close\n%s", before, after, buf[:runtime.Stack(buf, true)])
+}
@@ -0,0 +1,176 @@
+package openid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// metadata is the provider metadata obtained by discovery.
+type metadata struct {
+	Issuer        string   `json:"issuer"`
+	JWKSURL       string   `json:"jwks_uri"`
+	Algorithms    []string `json:"id_token_signing_alg_values_supported"`
+	EndSessionURL string   `json:"end_session_endpoint"`
+	ResponseTypes []string `json:"response_types_supported"`
+}
+
+// checkResponseType verifies the provider supports the response type of the
+// flow, if it advertises them.
+func checkResponseType(meta *metadata, flow Flow) error {
+	responseType := "id_token"
+	if flow == FlowCode {
+		responseType = "code"
+	}
+	if len(meta.ResponseTypes) == 0 || slices.Contains(meta.ResponseTypes, responseType) {
+		return nil
+	}
+	if flow == FlowImplicit {
+		return fmt.Errorf("provider does not support the id_token response type (supported: %v): use the code flow, see Config.Flow", strings.Join(meta.ResponseTypes, ", "))
+	}
+	return fmt.Errorf("provider does not support the code response type (supported: %v)", strings.Join(meta.ResponseTypes, ", "))
+}
+
+// aliases are the issuer URLs of common providers, see Config.Provider.
+// GitHub has none as it does not support OpenID Connect for user logins.
+var aliases = map[string]string{
+	"apple":     "https://appleid.apple.com",
+	"gitlab":    "https://gitlab.com",
+	"google":    "https://accounts.google.com",
+	"microsoft": "https://login.microsoftonline.com/%s/v2.0",
+	"okta":      "https://%s",
+}
+
+// expandProvider returns the issuer URL of a provider alias, or the provider
+// as is if it is not an alias.
+func expandProvider(provider string) (string, error) {
+	name, param, hasParam := strings.Cut(provider, ":")
+	if strings.HasPrefix(param, "//") {
+		return provider, nil // a URL
+	}
+	issuer, ok := aliases[name]
+	if !ok {
+		return provider, nil
+	}
+	if !strings.Contains(issuer, "%s") {
+		if hasParam {
+			return "", fmt.Errorf("invalid provider %q: alias %v takes no parameter", provider, name)
+		}
+		return issuer, nil
+	}
+	if param == "" || strings.ContainsAny(param, "/?#@") {
+		return "", fmt.Errorf("invalid provider %q: alias %v requires a parameter, see Config.Provider", provider, name)
+	}
+	return fmt.Sprintf(issuer, param), nil
+}
+
+// IssuerMismatchError is returned when the issuer obtained by discovery does
+// not match the configured provider, or Config.IssuerOverride if set.
+type IssuerMismatchError struct {
+	Expected   string
+	Discovered string
+}
+
+func (e *IssuerMismatchError) Error() string {
+	return fmt.Sprintf("issuer mismatch: expected %q but discovered issuer %q, configure the provider as the discovered issuer", e.Expected, e.Discovered)
+}
+
+// discover obtains the provider metadata.
+// The provider must be https. The discovered issuer must be the expected
+// issuer, unless empty, with a trailing slash difference tolerated, and the
+// discovered issuer is used.
+func discover(ctx context.Context, provider, issuer string) (*oidc.Provider, *metadata, error) {
+	if err := checkProvider(provider); err != nil {
+		return nil, nil, err
+	}
+	// The issuer is verified below, with a clearer error.
+	p, err := oidc.NewProvider(oidc.InsecureIssuerURLContext(ctx, provider), provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta metadata
+	if err := p.Claims(&meta); err != nil {
+		return nil, nil, err
+	}
+	if err := checkIssuer(issuer, meta.Issuer); err != nil {
+		return nil, nil, err
+	}
+	return p, &meta, nil
+}
+
+// checkProvider verifies the provider is an https URL.
+func checkProvider(provider string) error {
+	u, err := url.Parse(provider)
+	if err != nil {
+		return fmt.Errorf("invalid provider: %v", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid provider %q: must be an https URL", provider)
+	}
+	return nil
+}
+
+// discoverRetry obtains the provider metadata, from the cache if any, and
+// retries failures with exponential backoff per Config.DiscoveryRetries.
+// It also returns whether the metadata came from the cache.
+func discoverRetry(ctx context.Context, config *Config, c *cache) (*oidc.Provider, *metadata, bool, error) {
+	if err := checkProvider(config.Provider); err != nil {
+		return nil, nil, false, err
+	}
+	backoff := config.DiscoveryRetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for i := 0; ; i++ {
+		var p *oidc.Provider
+		var meta *metadata
+		var cached bool
+		var err error
+		if c != nil {
+			p, meta, cached, err = discoverCached(ctx, config.Provider, expectedIssuer(config), c)
+		} else {
+			p, meta, err = discover(ctx, config.Provider, expectedIssuer(config))
+		}
+		var mismatch *IssuerMismatchError
+		if err == nil || i >= config.DiscoveryRetries || errors.As(err, &mismatch) {
+			return p, meta, cached, err
+		}
+		log.Printf("openid: discovery failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, nil, false, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// expectedIssuer returns the issuer discovery must find: the provider unless
+// overridden, or none with Config.SkipIssuerCheck.
+func expectedIssuer(config *Config) string {
+	switch {
+	case config.SkipIssuerCheck:
+		return ""
+	case config.IssuerOverride != "":
+		return config.IssuerOverride
+	}
+	return config.Provider
+}
+
+// checkIssuer verifies the discovered issuer is the expected one, if any.
+func checkIssuer(expected, issuer string) error {
+	if expected == "" {
+		return nil
+	}
+	if strings.TrimRight(issuer, "/") != strings.TrimRight(expected, "/") {
+		return &IssuerMismatchError{Expected: expected, Discovered: issuer}
+	}
+	return nil
+}
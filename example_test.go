@@ -4,13 +4,16 @@ import (
         "context"
         "fmt"
         "net/http"
+        "net/http/httptest"
+        "net/url"
 
         "github.com/StalkR/openid"
+        "github.com/coreos/go-oidc/v3/oidc"
 )
 
-func ExampleNew() {
+func ExampleMustNew() {
         ctx := context.Background()
-        auth := openid.New(ctx, &openid.Config{
+        auth := openid.MustNew(ctx, &openid.Config{
                 Provider: "https://accounts.google.com",
                 ClientID: "xxx.apps.googleusercontent.com",
         })
@@ -23,3 +26,38 @@ func ExampleNew() {
                 fmt.Fprintf(w, "Hello %v", user)
         })
 }
+
+func ExampleAuth_Require() {
+        ctx := context.Background()
+        auth := openid.MustNew(ctx, &openid.Config{
+                Provider: "https://accounts.google.com",
+                ClientID: "xxx.apps.googleusercontent.com",
+        })
+        http.Handle("/admin", auth.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                user, _ := openid.UserFromContext(r.Context())
+                fmt.Fprintf(w, "Hello %v", user.Email)
+        })))
+}
+
+func ExampleNewWithProvider() {
+        // A fake provider, e.g. in tests, also serving its keys at /keys.
+        mux := http.NewServeMux()
+        srv := httptest.NewTLSServer(mux)
+        defer srv.Close()
+        mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+                fmt.Fprintf(w, `{"issuer": %[1]q, "authorization_endpoint": "%[1]s/auth", "jwks_uri": "%[1]s/keys"}`, srv.URL)
+        })
+        // Its client trusts its certificate, for discovery and keys.
+        ctx := oidc.ClientContext(context.Background(), srv.Client())
+        provider, err := oidc.NewProvider(ctx, srv.URL)
+        if err != nil {
+                panic(err)
+        }
+        auth := openid.NewWithProvider(ctx, "client", provider)
+
+        w := httptest.NewRecorder()
+        auth.Redirect(w, httptest.NewRequest("GET", "https://app.example/page", nil))
+        u, _ := url.Parse(w.Header().Get("Location"))
+        fmt.Println(u.Query().Get("client_id"), u.Query().Get("redirect_uri"))
+        // Output: client https://app.example/auth/callback
+}
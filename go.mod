@@ -4,10 +4,10 @@ go 1.21
 
 toolchain go1.23.0
 
-require github.com/coreos/go-oidc/v3 v3.11.0
-
 require (
-	github.com/go-jose/go-jose/v4 v4.0.4 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/oauth2 v0.24.0 // indirect
+	github.com/coreos/go-oidc/v3 v3.11.0
+	github.com/go-jose/go-jose/v4 v4.0.4
+	golang.org/x/oauth2 v0.24.0
 )
+
+require golang.org/x/crypto v0.31.0 // indirect
@@ -0,0 +1,154 @@
+package openid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// keySet implements oidc.KeySet with the provider keys at jwks_uri.
+// Unlike oidc.RemoteKeySet, it can be refreshed on demand.
+type keySet struct {
+	url    string
+	client *http.Client
+	cache  *cache // optional
+	sem    semaphore
+	bg     *background
+
+	mu       sync.RWMutex
+	keys     []jose.JSONWebKey
+	inflight chan struct{} // closed when the current fetch is done
+	err      error         // of the last fetch
+}
+
+var allAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// VerifySignature verifies the signature of the JWT and returns its payload.
+// Algorithms are checked by the oidc verifier, so it accepts any.
+// If no cached key verifies the JWT, keys are fetched again as the provider
+// may have rotated them.
+func (k *keySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, allAlgs)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if payload, ok := verifyJWS(jws, keys); ok {
+		return payload, nil
+	}
+	keys, err = k.refresh(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	if payload, ok := verifyJWS(jws, keys); ok {
+		return payload, nil
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+func verifyJWS(jws *jose.JSONWebSignature, keys []jose.JSONWebKey) ([]byte, bool) {
+	var keyID string
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+	for _, key := range keys {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// refresh fetches the keys, sharing the result with concurrent callers.
+func (k *keySet) refresh(ctx context.Context) ([]jose.JSONWebKey, error) {
+	k.mu.Lock()
+	inflight := k.inflight
+	if inflight == nil {
+		inflight = make(chan struct{})
+		// Not canceled with the first caller, which may be waited on by others.
+		started := k.bg.run(ctx, func(fetchCtx context.Context) {
+			keys, err := k.fetch(fetchCtx)
+			if err == nil && k.cache != nil {
+				k.cache.storeKeys(keys)
+			}
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			if err == nil {
+				k.keys = keys
+			}
+			k.err = err
+			k.inflight = nil
+			close(inflight)
+		})
+		if !started {
+			k.mu.Unlock()
+			return nil, errClosed
+		}
+		k.inflight = inflight
+	}
+	k.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-inflight:
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys, k.err
+}
+
+func (k *keySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	client := k.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := k.sem.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer k.sem.release()
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("malformed key set: %v", err)
+	}
+	return keySet.Keys, nil
+}
+
+// RefreshKeys fetches the provider keys again, e.g. after a key rotation,
+// rather than waiting for a token signed by an unknown key.
+func (s *Auth) RefreshKeys(ctx context.Context) error {
+	_, err := s.keys.refresh(ctx)
+	return err
+}
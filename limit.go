@@ -0,0 +1,26 @@
+package openid
+
+import "context"
+
+// semaphore limits concurrent calls, see Config.MaxConcurrentCalls.
+// A nil semaphore does not limit.
+type semaphore chan struct{}
+
+// acquire waits for a slot, or until the context is done.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
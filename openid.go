@@ -3,17 +3,26 @@ Package openid implements OpenID Connect authentication.
 
 The package uses the ID Token flow, as it conveniently stores the
 user email in the claims, so no further exchange requests are required.
+The code flow can be used instead with a client secret or PKCE (Config.Flow):
+the provider returns a code to the callback, exchanged for the ID token,
+without JavaScript.
 A temporary nonce cookie (__Host-AuthNonce) is established at the beginning
 and verified at the end of the flow, protecting against login CSRF.
 As the ID token is returned to the redirect URI in the fragment, a small
-JavaScript is responsible for sending it to the server via POST.
+JavaScript is responsible for sending it to the server via POST. The script
+has a per-response nonce, and with Config.EmitCSP it is served with a
+Content-Security-Policy allowing only this script.
 The ID token is then verified and stored in a cookie (__Host-AuthToken) with
-an expiration of 1 year.
+an expiration of 1 year by default.
+The user is then sent back to the URL that triggered the login, kept in a
+signed state cookie (__Host-AuthState) alongside the nonce.
 On future requests, the ID token is obtained and verified from the cookie,
 and the user email can be extracted.
 Since the ID token expiration is typically only 1h, expiry is only verified
-during authentication and not in subsequent requests.
-The user email must be verified at the provider.
+during authentication and not in subsequent requests, unless enforced.
+In the code flow, expired tokens can be renewed with a refresh token
+(Config.EnableRefresh).
+The user email must be verified at the provider, see Config.AllowUnverifiedEmail.
 
 To use it:
 
@@ -25,13 +34,14 @@ To use it:
    https://console.developers.google.com/apis/credentials/consent
  - create an OAuth Client ID credential of type Web, e.g. at
    https://console.developers.google.com/apis/credentials
- - for authorized redirect URIs add your origin + /auth/callback
+ - for authorized redirect URIs add your origin + /auth/callback, or the
+   configured callback path
  - create and copy the client ID, the client secret is not needed
 
 3) Use the package
 
         ctx := context.Background()
-        auth := openid.New(ctx, &openid.Config{
+        auth := openid.MustNew(ctx, &openid.Config{
                 Provider: "https://accounts.google.com",
                 ClientID: "xxx.apps.googleusercontent.com",
         })
@@ -43,170 +53,1946 @@ To use it:
                 }
                 fmt.Fprintf(w, "Hello %v", user)
         })
+
+Sign in with Apple: use provider https://appleid.apple.com and a Services ID
+as client ID. Apple sends email_verified as a string, which is accepted.
+The email is always in the ID token, but the user name is only sent on the
+first authorization, outside of the token, so it is not available.
+Apple requires form_post when scopes are requested: set Config.ResponseMode.
 */
 package openid
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"html/template"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
 )
 
 // Config configures the auth module.
 type Config struct {
+	// Provider is the issuer URL of the provider, or an alias: google, apple,
+	// gitlab, microsoft:<tenant ID> or okta:<domain>.
 	Provider string
 	ClientID string
+	// AdditionalClientIDs are other clients whose tokens are accepted too,
+	// e.g. a native app sharing the backend. Logins still use ClientID.
+	AdditionalClientIDs []string
+	// ClientSecret authenticates the client at the token endpoint, for the
+	// code flow.
+	ClientSecret string
+	// Flow is the OpenID Connect flow. Defaults to FlowImplicit.
+	Flow Flow
+	// ResponseMode is how the provider returns to the callback: fragment
+	// (default) or form_post, where the provider posts to the callback
+	// without JavaScript, if supported (e.g. Google, Microsoft, Apple).
+	ResponseMode string
+	// FetchUserInfo gets the name and picture of the user at the userinfo
+	// endpoint at login if the ID token lacks them, kept in a cookie for
+	// UserInfo. It requires the code flow, for the access token.
+	FetchUserInfo bool
+	// EnableRefresh keeps the refresh token of the code flow, encrypted in a
+	// cookie, to renew expired tokens with Refresh, which Require does with
+	// EnforceExpiryInUser. Request it, e.g. with the offline_access scope.
+	// Without Secret, refresh tokens do not survive a restart.
+	EnableRefresh bool
+	// UsePKCE protects the code of the code flow with PKCE (RFC 7636), so it
+	// is useless to whoever intercepts it. The client secret is then optional.
+	UsePKCE bool
+	// CallbackPath is the path of the redirect URI. Defaults to /auth/callback.
+	CallbackPath string
+	// Mux is where the handlers are registered, e.g. an http.ServeMux.
+	// Defaults to http.DefaultServeMux.
+	Mux Mux
+	// Scopes to request, openid and email are always added.
+	// For example profile yields name and picture claims.
+	// Defaults to only email with the implicit flow, and openid and email with
+	// the code flow.
+	Scopes []string
+	// Prompt is the prompt parameter of the auth URL, e.g. select_account for
+	// users to choose an account, or login to always re-authenticate: none,
+	// login, consent or select_account, or several separated by spaces.
+	// With none, the provider fails the login if the user has no session
+	// there, e.g. with login_required, returned as a ProviderError.
+	Prompt string
+	// ConnectionParam is the parameter of the auth URL set by
+	// RedirectWithConnection, e.g. connection for Auth0, idp for Okta or
+	// organization for WorkOS. Defaults to connection. Parameters set by the
+	// module, e.g. prompt or max_age, are rejected.
+	ConnectionParam string
+	// ModifyAuthURL, if set, is called with the URL of the provider before
+	// redirecting to it, after the standard parameters are set, for provider
+	// specific requirements.
+	ModifyAuthURL func(*url.URL)
+
+	// CookiePrefix is the prefix of the cookie names, followed by Nonce, State,
+	// Token, Session, Refresh, ID and Profile, e.g. to run several instances in
+	// the same app.
+	// Defaults to __Host-Auth, __Secure-Auth with CookieDomain, or Auth if
+	// Insecure.
+	CookiePrefix string
+	// CookieDomain is the Domain attribute of the cookies, to share the login
+	// with subdomains, e.g. example.com for app.example.com and
+	// api.example.com. Requests must be for this domain or its subdomains.
+	// Defaults to host-only cookies.
+	CookieDomain string
+	// SameSite is the SameSite attribute of the cookies, unless set per cookie
+	// below. None requires secure cookies.
+	SameSite http.SameSite
+	// NonceSameSite is the SameSite attribute of the nonce cookie.
+	// Defaults to SameSite, or Lax so it survives the cross-site return from
+	// the provider, or None with form_post. Strict is rejected in the code
+	// flow, and Lax with form_post, as the cookie would not be sent.
+	NonceSameSite http.SameSite
+	// TokenSameSite is the SameSite attribute of the token cookie.
+	// Defaults to SameSite, or Strict, or Lax in the code flow and with
+	// form_post as the cookie is set on the cross-site return from the provider.
+	TokenSameSite http.SameSite
+
+	// EmailVerifiedClaim is the name of the claim indicating the email is
+	// verified, e.g. verified_email for some providers. Defaults to email_verified.
+	EmailVerifiedClaim string
+	// EmailClaim, NameClaim and SubjectClaim are the names of the claims of
+	// the email, name and subject, for providers shaping tokens differently,
+	// e.g. oid as subject. Default to email, name and sub.
+	EmailClaim   string
+	NameClaim    string
+	SubjectClaim string
+	// AllowUnverifiedEmail accepts users whose email is not verified, with
+	// Identity.EmailVerified false, e.g. to restrict them during onboarding.
+	// Such emails may belong to someone else: they are still rejected with
+	// AllowedDomains, and by IsUser.
+	AllowUnverifiedEmail bool
+
+	// RequiredScopes must all be granted in the scope (or scp) claim of the token.
+	RequiredScopes []string
+	// RequiredACR lists the acceptable values of the acr claim, e.g. one
+	// requiring multi-factor authentication. They are requested with
+	// acr_values, and logins with another acr are rejected at the callback.
+	RequiredACR []string
+	// MaxAge requires the user to have authenticated at the provider within
+	// this duration, requested with max_age and verified with the auth_time
+	// claim at the callback, e.g. for step-up authentication.
+	MaxAge time.Duration
+
+	// KeepNonceOnFailure keeps the nonce cookie when the callback fails, so the
+	// flow can be retried. By default it is cleared whatever the outcome.
+	KeepNonceOnFailure bool
+	// HashedNonce accepts the SHA-256 of the nonce in the token, in hex or
+	// base64url, for providers returning it hashed.
+	HashedNonce bool
+	// CheckOrigin rejects callback POSTs whose Origin, or Referer if absent, is
+	// not our own, in addition to the nonce against cross-site submission.
+	// The callback page posts from our origin, but not form_post providers.
+	CheckOrigin bool
+	// NonceFunc generates the nonces, e.g. a fixed one in tests.
+	// Defaults to 20 random bytes in hex. It must be unpredictable.
+	NonceFunc func() string
+
+	// SessionDuration is the lifetime of the token cookie. Defaults to 1 year.
+	// Users not remembered (see RedirectRemember) get a browser session cookie.
+	SessionDuration time.Duration
+	// EnforceExpiryInUser verifies the token expiry in User and the other
+	// session accessors, typically 1 hour, returning ErrExpired, rather than
+	// keeping the session for SessionDuration. Require logs in again.
+	EnforceExpiryInUser bool
+	// SlidingSession extends the token cookie on each authenticated request,
+	// so that active users stay logged in and idle ones expire.
+	// It requires the Require middleware, which has the ResponseWriter.
+	SlidingSession bool
+
+	// PostLoginPath is where the user is sent after login when the URL that
+	// triggered it is unknown, e.g. from the login handler. Defaults to /.
+	PostLoginPath string
+	// RedirectCode is the status of the redirect after login: http.StatusFound
+	// (the default) or http.StatusSeeOther. Others would be cached (301) or
+	// repeat the callback post with the token to the target (307, 308).
+	RedirectCode int
+	// PostLogoutRedirect is where the user is sent after logout: a local path
+	// or an absolute URL registered at the provider. Defaults to /.
+	PostLogoutRedirect string
+	// LogoutPath is an optional path where a handler calling Logout is
+	// registered.
+	LogoutPath string
+	// LoginPath is an optional path where a login handler is registered, for
+	// links to log in, e.g. /auth/login?return=/page to return to /page.
+	LoginPath string
+
+	// OnVerifyFailure is called when the verification of a token fails, with
+	// the client IP and the reason, e.g. to feed a rate limiter.
+	OnVerifyFailure func(ip string, reason error)
+	// OnFirstLogin is called at the callback when a user logs in for the first
+	// time according to KnownUser, e.g. to provision an account. An error
+	// aborts the login.
+	OnFirstLogin func(*User) error
+	// KnownUser returns whether the user has already logged in, for
+	// OnFirstLogin which requires it, e.g. whether an account exists for the
+	// issuer and subject. Sessions do not tell as they end on logout.
+	KnownUser func(*User) (bool, error)
+
+	// Secret is a key to authenticate values, e.g. to bind the nonce to the
+	// redirect URI so that a token obtained for another one is rejected.
+	// Without it, a random key is used for the login state, so with several
+	// instances the login may not return to the original URL.
+	Secret []byte
+	// APITokenDuration is the lifetime of API tokens. Defaults to 15 minutes.
+	APITokenDuration time.Duration
+	// APIAudience is the audience of API tokens, so that those of another app
+	// sharing the Secret are rejected. Defaults to the client ID.
+	APIAudience string
+
+	// HostFunc returns the external scheme and host of a request, e.g. from a
+	// trusted Forwarded header, to build the redirect URI.
+	// Defaults to https and the request Host.
+	HostFunc func(r *http.Request) (scheme, host string)
+
+	// NonceOptional accepts tokens without nonce, for providers which do not
+	// support it, by checking the state parameter instead. It is a weaker
+	// protection against login CSRF since the state is not bound to the token.
+	NonceOptional bool
+
+	// EmitCSP sets a Content-Security-Policy header on the callback page,
+	// allowing only its script, unless the app manages CSP elsewhere.
+	EmitCSP bool
+	// CallbackTemplate renders the callback page, which forwards the fragment
+	// to the server, with CallbackData. Defaults to a minimal script.
+	CallbackTemplate *template.Template
+	// ErrorTemplate renders the error pages with ErrorData.
+	// Defaults to plain text errors.
+	ErrorTemplate *template.Template
+	// ErrorHandler replies to the errors of the handlers, e.g. in JSON.
+	// Callback errors wrap ErrInvalidToken or ErrInvalidNonce when the
+	// verification fails, to hide details with errors.Is.
+	// It takes precedence over ErrorTemplate.
+	ErrorHandler ErrorHandler
+
+	// RequireSingleAudience rejects tokens issued for other clients too.
+	RequireSingleAudience bool
+	// VerifyAzp requires the azp (authorized party) claim of tokens with
+	// several audiences to be the client ID, or one of AdditionalClientIDs.
+	VerifyAzp bool
+
+	// SessionStore, if set, records the login sessions with their metadata,
+	// identified by a cookie, for Sessions and RevokeSession. Tokens of
+	// sessions no longer in the store are rejected with ErrSessionRevoked.
+	SessionStore SessionStore
+
+	// ReplayStore, if set, records the token IDs (jti claim) received by the
+	// callback to reject replays. Tokens without ID are then rejected.
+	ReplayStore ReplayStore
+	// Store, if set, keeps the ID tokens server-side with only an opaque ID in
+	// the token cookie, e.g. for tokens too large for cookies. Otherwise, a
+	// token exceeding the cookie size limit is split across a few cookies.
+	Store Store
+
+	// AllowedDomains, if set, restricts users to these email domains.
+	// With one domain, it is also requested to Google with the hd parameter.
+	AllowedDomains []string
+
+	// ClockSkew is tolerated when verifying the token expiry, between the
+	// clocks of the provider and this server. Defaults to 1 minute.
+	ClockSkew time.Duration
+	// Now, if set, is the clock used to verify tokens, e.g. to reproduce
+	// clock skew issues. Defaults to time.Now.
+	Now func() time.Time
+
+	// DiscoveryRetries is how many times New retries a failed discovery, e.g.
+	// when the provider starts at the same time. Defaults to none.
+	DiscoveryRetries int
+	// DiscoveryRetryBackoff is the delay before the first retry, doubled at
+	// each retry. Defaults to 1 second.
+	DiscoveryRetryBackoff time.Duration
+
+	// IssuerOverride is the issuer expected at discovery and in tokens, when
+	// it differs from the provider URL, e.g. a regional endpoint.
+	IssuerOverride string
+	// SkipIssuerCheck accepts any issuer at discovery and in tokens, e.g. for
+	// Azure AD multi-tenant whose issuer is templated with the tenant.
+	// This is insecure: tokens of any issuer sharing the provider keys are
+	// accepted, e.g. of any tenant, so restrict users with AllowedDomains or
+	// by checking Identity.Issuer.
+	SkipIssuerCheck bool
+
+	// CacheDir, if set, is a directory to cache the provider metadata and keys,
+	// for fast starts even if the provider is unreachable. They are used at
+	// start if cached, and refreshed in the background. Refreshed metadata,
+	// e.g. a new jwks_uri, only takes effect at the next start; the keys are
+	// refreshed from the cached jwks_uri.
+	CacheDir string
+
+	// MaxConcurrentCalls, if set, limits the concurrent calls to the provider
+	// to verify users (key fetches, code exchanges), e.g. to withstand a
+	// surge of logins. Calls wait until the request context is done.
+	MaxConcurrentCalls int
+
+	// Insecure allows plain HTTP, for local development only: cookies are
+	// not Secure, so the default CookiePrefix is Auth, and the redirect URI
+	// has the scheme of the request. Never use it in production.
+	Insecure bool
+
+	// HTTPClient is used for discovery, to fetch the provider keys and to
+	// exchange codes, e.g. for a proxy or a mock in tests.
+	// Defaults to http.DefaultClient, or a client set with oidc.ClientContext.
+	// Keys are fetched when a token is signed by an unknown key: a request
+	// waits at most until its context is done, but the fetch goes on for the
+	// other requests, so set a client Timeout to bound it.
+	HTTPClient *http.Client
 }
 
-const callback = "/auth/callback"
+// Mux registers handlers, e.g. *http.ServeMux.
+type Mux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// Flow is an OpenID Connect flow.
+type Flow int
+
+const (
+	// FlowImplicit returns the ID token to the browser, which forwards it
+	// to the callback with a small JavaScript.
+	FlowImplicit Flow = iota
+	// FlowCode returns a code to the callback, exchanged for the ID token at
+	// the token endpoint with the client secret.
+	FlowCode
+)
+
+var errNoClientSecret = errors.New("code flow without ClientSecret; set Config.ClientSecret or Config.UsePKCE")
+
+const defaultCallbackPath = "/auth/callback"
 
-// New creates a new authentication module.
-// It registers a handler at /auth/callback for the provider.
-func New(ctx context.Context, config *Config) *Auth {
-	provider, err := oidc.NewProvider(ctx, config.Provider)
+// New creates a new authentication module, after discovery at the provider.
+// It registers a handler at Config.CallbackPath for the provider, and at
+// Config.LoginPath and Config.LogoutPath if set, on Config.Mux.
+func New(ctx context.Context, config *Config) (*Auth, error) {
+	provider, err := expandProvider(config.Provider)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	c := *config
+	c.Provider = provider
+	return newAuth(ctx, &c, nil)
+}
+
+// NewWithProvider creates a new authentication module for a provider
+// discovered with oidc.NewProvider, e.g. a fake one in tests, with the default
+// configuration. It panics on error like MustNew.
+// Handlers are not registered: serve Handler at /auth/callback if needed.
+// Keys are fetched with the client of the context if set with
+// oidc.ClientContext, as for discovery, e.g. that of a httptest.Server.
+func NewWithProvider(ctx context.Context, clientID string, p *oidc.Provider) *Auth {
+	var meta metadata
+	if err := p.Claims(&meta); err != nil {
+		panic(fmt.Sprintf("openid: %v", err))
+	}
+	auth, err := newAuth(ctx, &Config{
+		Provider: meta.Issuer,
+		ClientID: clientID,
+		Mux:      http.NewServeMux(),
+	}, p)
+	if err != nil {
+		panic(fmt.Sprintf("openid: %v", err))
+	}
+	return auth
+}
+
+// newAuth creates a new authentication module, after discovery at the
+// provider unless it is given.
+func newAuth(ctx context.Context, config *Config, provider *oidc.Provider) (*Auth, error) {
+	if config.ClientID == "" {
+		return nil, errEmptyClientID
+	}
+	if config.Flow == FlowCode && config.ClientSecret == "" && !config.UsePKCE {
+		return nil, errNoClientSecret
+	}
+	if config.EnableRefresh && config.Flow != FlowCode {
+		return nil, errors.New("EnableRefresh requires the code flow")
+	}
+	if config.FetchUserInfo && config.Flow != FlowCode {
+		return nil, errors.New("FetchUserInfo requires the code flow")
+	}
+	callbackPath := config.CallbackPath
+	if callbackPath == "" {
+		callbackPath = defaultCallbackPath
+	}
+	if !isLocalPath(callbackPath) {
+		return nil, fmt.Errorf("invalid CallbackPath: %v: must be an absolute path", callbackPath)
+	}
+	cookieDomain := strings.TrimPrefix(strings.ToLower(config.CookieDomain), ".")
+	if cookieDomain != "" {
+		if !strings.Contains(cookieDomain, ".") || strings.ContainsAny(cookieDomain, ":/ ") {
+			return nil, fmt.Errorf("invalid CookieDomain: %v", config.CookieDomain)
+		}
+	}
+	cookiePrefix := config.CookiePrefix
+	if cookiePrefix == "" {
+		cookiePrefix = defaultCookiePrefix
+		if cookieDomain != "" {
+			cookiePrefix = "__Secure-Auth"
+		}
+		if config.Insecure {
+			cookiePrefix = "Auth"
+		}
+	}
+	// Browsers reject __Host- cookies with a domain.
+	if cookieDomain != "" && strings.HasPrefix(cookiePrefix, "__Host-") {
+		return nil, fmt.Errorf("invalid CookiePrefix: %v: not allowed with CookieDomain", cookiePrefix)
+	}
+	switch config.ResponseMode {
+	case "", "fragment":
+	case "form_post":
+		if config.Insecure {
+			return nil, errors.New("ResponseMode form_post requires secure cookies, not Insecure")
+		}
+		if config.CheckOrigin {
+			return nil, errors.New("ResponseMode form_post is posted by the provider, not compatible with CheckOrigin")
+		}
+	default:
+		return nil, fmt.Errorf("invalid ResponseMode: %v", config.ResponseMode)
+	}
+	for _, sameSite := range []http.SameSite{config.SameSite, config.NonceSameSite, config.TokenSameSite} {
+		// Browsers reject SameSite=None cookies without Secure.
+		if sameSite == http.SameSiteNoneMode && config.Insecure {
+			return nil, errors.New("SameSite None requires secure cookies, not Insecure")
+		}
+	}
+	// The nonce cookie must be sent on the cross-site return from the provider:
+	// a navigation in the code flow, a post with form_post.
+	nonceSameSite := config.NonceSameSite
+	if nonceSameSite == 0 {
+		nonceSameSite = config.SameSite
+	}
+	formPost := config.ResponseMode == "form_post"
+	if nonceSameSite == http.SameSiteStrictMode && (config.Flow == FlowCode || formPost) ||
+		nonceSameSite == http.SameSiteLaxMode && formPost {
+		return nil, errors.New("the nonce cookie would not be sent on the return from the provider: set NonceSameSite to Lax in the code flow, None with form_post")
+	}
+	if config.Insecure {
+		if strings.HasPrefix(cookiePrefix, "__Host-") || strings.HasPrefix(cookiePrefix, "__Secure-") {
+			return nil, fmt.Errorf("invalid CookiePrefix: %v: requires secure cookies, not Insecure", cookiePrefix)
+		}
+		log.Print("openid: Insecure mode, for development only")
 	}
+	if err := (&http.Cookie{Name: cookiePrefix + "Token"}).Valid(); err != nil {
+		return nil, fmt.Errorf("invalid CookiePrefix: %v", err)
+	}
+	if p := config.LoginPath; p != "" && !isLocalPath(p) {
+		return nil, fmt.Errorf("invalid LoginPath: %v: must be an absolute path", p)
+	}
+	if p := config.LogoutPath; p != "" && !isLocalPath(p) {
+		return nil, fmt.Errorf("invalid LogoutPath: %v: must be an absolute path", p)
+	}
+	switch config.ConnectionParam {
+	case "response_type", "client_id", "redirect_uri", "scope", "nonce", "state",
+		"response_mode", "code_challenge", "code_challenge_method",
+		"prompt", "login_hint", "hd", "acr_values", "max_age":
+		return nil, fmt.Errorf("invalid ConnectionParam: %v is reserved", config.ConnectionParam)
+	}
+	if config.OnFirstLogin != nil && config.KnownUser == nil {
+		return nil, errors.New("OnFirstLogin requires KnownUser")
+	}
+	if err := checkPrompt(config.Prompt); err != nil {
+		return nil, err
+	}
+	if p := config.PostLoginPath; p != "" && !isLocalPath(p) {
+		return nil, fmt.Errorf("invalid PostLoginPath: %v: must be an absolute path", p)
+	}
+	switch config.RedirectCode {
+	case 0, http.StatusFound, http.StatusSeeOther:
+	default:
+		return nil, fmt.Errorf("invalid RedirectCode: %v", config.RedirectCode)
+	}
+	if p := config.PostLogoutRedirect; p != "" && !isLocalPath(p) {
+		if u, err := url.Parse(p); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid PostLogoutRedirect: %v", p)
+		}
+	}
+	if config.SkipIssuerCheck && config.IssuerOverride != "" {
+		return nil, errors.New("SkipIssuerCheck and IssuerOverride are exclusive")
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client, _ = ctx.Value(oauth2.HTTPClient).(*http.Client)
+	} else {
+		ctx = oidc.ClientContext(ctx, client)
+	}
+	var c *cache
+	var cached bool
+	var meta *metadata
+	var err error
+	if provider != nil {
+		meta = new(metadata)
+		err = provider.Claims(meta)
+	} else {
+		if config.CacheDir != "" {
+			c = newCache(config.CacheDir, config.Provider)
+		}
+		provider, meta, cached, err = discoverRetry(ctx, config, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponseType(meta, config.Flow); err != nil {
+		return nil, err
+	}
+	if config.Flow == FlowCode && provider.Endpoint().TokenURL == "" {
+		return nil, errors.New("provider has no token endpoint, required by the code flow")
+	}
+	var sem semaphore
+	if config.MaxConcurrentCalls > 0 {
+		sem = make(semaphore, config.MaxConcurrentCalls)
+	}
+	bg := newBackground()
 	auth := &Auth{
-		clientID: config.ClientID,
-		provider: provider,
+		bg:              bg,
+		clientID:        config.ClientID,
+		clientIDs:       append([]string{config.ClientID}, config.AdditionalClientIDs...),
+		clientSecret:    config.ClientSecret,
+		flow:            config.Flow,
+		formPost:        config.ResponseMode == "form_post",
+		usePKCE:         config.UsePKCE,
+		enableRefresh:   config.EnableRefresh,
+		fetchUserInfo:   config.FetchUserInfo,
+		modifyAuthURL:   config.ModifyAuthURL,
+		connectionParam: config.ConnectionParam,
+		prompt:          config.Prompt,
+		client:          client,
+		sem:             sem,
+		callbackPath:    callbackPath,
+		loginPath:       config.LoginPath,
+		scope:           scope(config.Scopes, config.Flow),
+		provider:        provider,
+		nonceSameSite:   config.NonceSameSite,
+		tokenSameSite:   config.TokenSameSite,
+		nonceCookie:     cookiePrefix + "Nonce",
+		stateCookie:     cookiePrefix + "State",
+		tokenCookie:     cookiePrefix + "Token",
+		sessionCookie:   cookiePrefix + "Session",
+		refreshCookie:   cookiePrefix + "Refresh",
+		sessionIDCookie: cookiePrefix + "ID",
+		cookieDomain:    cookieDomain,
+		profileCookie:   cookiePrefix + "Profile",
+
+		emailVerifiedClaim: config.EmailVerifiedClaim,
+		emailClaim:         config.EmailClaim,
+		nameClaim:          config.NameClaim,
+		subjectClaim:       config.SubjectClaim,
+		allowUnverified:    config.AllowUnverifiedEmail,
+		requiredScopes:     config.RequiredScopes,
+		requiredACR:        config.RequiredACR,
+		maxAge:             config.MaxAge,
+		keepNonceOnFailure: config.KeepNonceOnFailure,
+		hashedNonce:        config.HashedNonce,
+		nonceFunc:          config.NonceFunc,
+		checkOrigin:        config.CheckOrigin,
+		postLoginPath:      config.PostLoginPath,
+		redirectCode:       config.RedirectCode,
+		postLogoutRedirect: config.PostLogoutRedirect,
+		onVerifyFailure:    config.OnVerifyFailure,
+		onFirstLogin:       config.OnFirstLogin,
+		knownUser:          config.KnownUser,
+		sessionMaxAge:      int(config.SessionDuration.Seconds()),
+		slidingSession:     config.SlidingSession,
+		enforceExpiry:      config.EnforceExpiryInUser,
+		secret:             config.Secret,
+		key:                config.Secret,
+		apiTokenDuration:   config.APITokenDuration,
+		apiAudience:        config.APIAudience,
+		hostFunc:           config.HostFunc,
+		nonceOptional:      config.NonceOptional,
+		emitCSP:            config.EmitCSP,
+		callbackTemplate:   config.CallbackTemplate,
+		errorTemplate:      config.ErrorTemplate,
+		errorHandler:       config.ErrorHandler,
+		replayStore:        config.ReplayStore,
+		store:              config.Store,
+		sessionStore:       config.SessionStore,
+		singleAudience:     config.RequireSingleAudience,
+		verifyAzp:          config.VerifyAzp,
+		now:                config.Now,
+		clockSkew:          config.ClockSkew,
+		insecure:           config.Insecure,
+		allowedDomains:     config.AllowedDomains,
+
+		keys: &keySet{url: meta.JWKSURL, client: client, cache: c, sem: sem, bg: bg},
+
+		endSessionURL: meta.EndSessionURL,
+	}
+	if auth.nonceSameSite == 0 {
+		auth.nonceSameSite = config.SameSite
+	}
+	if auth.tokenSameSite == 0 {
+		auth.tokenSameSite = config.SameSite
+	}
+	// The cross-site post of the provider only has SameSite=None cookies.
+	if auth.nonceSameSite == 0 && auth.formPost {
+		auth.nonceSameSite = http.SameSiteNoneMode
+	}
+	if auth.nonceSameSite == 0 {
+		auth.nonceSameSite = http.SameSiteLaxMode
+	}
+	if auth.tokenSameSite == 0 && (auth.flow == FlowCode || auth.formPost) {
+		auth.tokenSameSite = http.SameSiteLaxMode
+	}
+	if auth.tokenSameSite == 0 {
+		auth.tokenSameSite = http.SameSiteStrictMode
+	}
+	if auth.emailVerifiedClaim == "" {
+		auth.emailVerifiedClaim = "email_verified"
+	}
+	if auth.emailClaim == "" {
+		auth.emailClaim = "email"
+	}
+	if auth.nameClaim == "" {
+		auth.nameClaim = "name"
+	}
+	if auth.callbackTemplate == nil {
+		auth.callbackTemplate = callbackTemplate
+	}
+	if auth.sessionMaxAge <= 0 {
+		const oneYear = 365 * 24 * 60 * 60
+		auth.sessionMaxAge = oneYear
+	}
+	if auth.clockSkew == 0 {
+		auth.clockSkew = time.Minute
+	}
+	if auth.now == nil {
+		auth.now = time.Now
+	}
+	if auth.key == nil {
+		auth.key = randBytes(32)
+	}
+	if auth.apiTokenDuration <= 0 {
+		auth.apiTokenDuration = 15 * time.Minute
+	}
+	if auth.apiAudience == "" {
+		auth.apiAudience = auth.clientID
+	}
+	if auth.connectionParam == "" {
+		auth.connectionParam = "connection"
+	}
+	if auth.postLoginPath == "" {
+		auth.postLoginPath = "/"
+	}
+	if auth.redirectCode == 0 {
+		auth.redirectCode = http.StatusFound
+	}
+	if auth.postLogoutRedirect == "" {
+		auth.postLogoutRedirect = "/"
+	}
+	issuer := meta.Issuer
+	if config.IssuerOverride != "" {
+		issuer = config.IssuerOverride
+	}
+	var algorithms []string
+	for _, alg := range meta.Algorithms {
+		if supportedAlgs[alg] {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	// Built once as it is used for every request. The audience and expiry are
+	// checked by verify, once the signature is verified, to report a mismatch
+	// distinctly and tolerate clock skew.
+	auth.verifier = oidc.NewVerifier(issuer, auth.keys, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+		SkipIssuerCheck:      config.SkipIssuerCheck,
+		SupportedSigningAlgs: algorithms,
+		Now:                  auth.now,
+	})
+	if c != nil {
+		auth.keys.keys = c.loadKeys()
+	}
+	if cached {
+		bg.run(ctx, func(ctx context.Context) {
+			auth.refreshCache(ctx, config.Provider, expectedIssuer(config), c)
+		})
+	}
+	var mux Mux = http.DefaultServeMux
+	if config.Mux != nil {
+		mux = config.Mux
+	}
+	mux.Handle(callbackPath, auth.Handler())
+	if config.LoginPath != "" {
+		mux.Handle(config.LoginPath, http.HandlerFunc(auth.login))
+	}
+	if config.LogoutPath != "" {
+		mux.Handle(config.LogoutPath, http.HandlerFunc(auth.Logout))
+	}
+	return auth, nil
+}
+
+// MustNew is like New but panics on error.
+func MustNew(ctx context.Context, config *Config) *Auth {
+	auth, err := New(ctx, config)
+	if err != nil {
+		panic(fmt.Sprintf("openid: %v", err))
 	}
-	http.HandleFunc(callback, auth.handle)
 	return auth
 }
 
+// scope returns the scope parameter for the scopes, with openid and email.
+// Without scopes, the implicit flow only requests email, which suffices for an
+// ID token, while the code flow needs openid for the token response to have one.
+func scope(scopes []string, flow Flow) string {
+	if len(scopes) == 0 && flow == FlowImplicit {
+		return "email"
+	}
+	r := []string{oidc.ScopeOpenID, "email"}
+	for _, e := range scopes {
+		dup := false
+		for _, f := range r {
+			if e == f {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			r = append(r, e)
+		}
+	}
+	return strings.Join(r, " ")
+}
+
+var errEmptyClientID = errors.New("ClientID is empty; set Config.ClientID")
+
 // Auth represents the auth module.
 type Auth struct {
-	clientID string
-	provider *oidc.Provider
+	bg              *background
+	clientID        string
+	clientIDs       []string // accepted audiences
+	clientSecret    string
+	flow            Flow
+	formPost        bool
+	usePKCE         bool
+	enableRefresh   bool
+	fetchUserInfo   bool
+	modifyAuthURL   func(*url.URL)
+	connectionParam string
+	prompt          string
+	client          *http.Client
+	sem             semaphore
+	callbackPath    string
+	loginPath       string
+	scope           string
+	provider        *oidc.Provider
+	nonceSameSite   http.SameSite
+	tokenSameSite   http.SameSite
+	nonceCookie     string
+	stateCookie     string
+	tokenCookie     string
+	sessionCookie   string // set if the token cookie is for the browser session
+	refreshCookie   string
+	sessionIDCookie string // with SessionStore
+	profileCookie   string // with FetchUserInfo
+	cookieDomain    string
+
+	emailVerifiedClaim string
+	emailClaim         string
+	nameClaim          string
+	subjectClaim       string
+	allowUnverified    bool
+	requiredScopes     []string
+	requiredACR        []string
+	maxAge             time.Duration
+	keepNonceOnFailure bool
+	hashedNonce        bool
+	nonceFunc          func() string // nil for randomNonce
+	checkOrigin        bool
+	postLoginPath      string
+	redirectCode       int
+	postLogoutRedirect string
+	onVerifyFailure    func(ip string, reason error)
+	onFirstLogin       func(*User) error
+	knownUser          func(*User) (bool, error)
+	sessionMaxAge      int
+	slidingSession     bool
+	enforceExpiry      bool
+	secret             []byte
+	key                []byte
+	apiTokenDuration   time.Duration
+	apiAudience        string
+	hostFunc           func(r *http.Request) (scheme, host string)
+	nonceOptional      bool
+	emitCSP            bool
+	callbackTemplate   *template.Template
+	errorTemplate      *template.Template
+	errorHandler       ErrorHandler
+	replayStore        ReplayStore
+	store              Store
+	sessionStore       SessionStore
+	singleAudience     bool
+	verifyAzp          bool
+	now                func() time.Time
+	clockSkew          time.Duration
+	insecure           bool
+	allowedDomains     []string
+
+	keys     *keySet
+	verifier *oidc.IDTokenVerifier
+
+	endSessionURL string
 }
 
-const (
-	nonceCookie = "__Host-AuthNonce"
-	tokenCookie = "__Host-AuthToken"
-)
+var supportedAlgs = map[string]bool{
+	oidc.RS256: true, oidc.RS384: true, oidc.RS512: true,
+	oidc.ES256: true, oidc.ES384: true, oidc.ES512: true,
+	oidc.PS256: true, oidc.PS384: true, oidc.PS512: true,
+	oidc.EdDSA: true,
+}
+
+// defaultCookiePrefix makes the browser require the cookies to be Secure,
+// with Path / and without Domain, which setCookie does.
+const defaultCookiePrefix = "__Host-Auth"
 
 // Redirect redirects the user to the provider for authentication.
+// After login, the user returns to the URL of the request.
 func (s *Auth) Redirect(w http.ResponseWriter, r *http.Request) {
-	deleteCookie(w, tokenCookie)
-	nonce := hex.EncodeToString(randBytes(20))
+	const remember = true
+	s.RedirectRemember(w, r, remember)
+}
+
+// RedirectRemember is like Redirect with the choice of the user to be
+// remembered, e.g. from a login form. If not, the token cookie lasts only
+// for the browser session instead of Config.SessionDuration.
+func (s *Auth) RedirectRemember(w http.ResponseWriter, r *http.Request, remember bool) {
+	s.redirect(w, r, r.URL.RequestURI(), remember, nil)
+}
+
+// RedirectWithConnection is like Redirect but routes the login to a specific
+// connection of the provider, e.g. an enterprise SSO connection of a broker,
+// skipping its account chooser. See Config.ConnectionParam.
+func (s *Auth) RedirectWithConnection(w http.ResponseWriter, r *http.Request, connection string) {
+	const remember = true
+	s.redirect(w, r, r.URL.RequestURI(), remember, url.Values{s.connectionParam: {connection}})
+}
+
+// RedirectHint is like Redirect with the email of the user as login_hint, to
+// prefill the account picker of the provider. It is omitted if empty.
+func (s *Auth) RedirectHint(w http.ResponseWriter, r *http.Request, email string) {
+	const remember = true
+	s.redirect(w, r, r.URL.RequestURI(), remember, url.Values{"login_hint": {email}})
+}
+
+// RedirectWithPrompt is like Redirect with a prompt parameter overriding
+// Config.Prompt, e.g. login to force a re-authentication on sensitive routes.
+func (s *Auth) RedirectWithPrompt(w http.ResponseWriter, r *http.Request, prompt string) {
+	if err := checkPrompt(prompt); err != nil {
+		s.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	const remember = true
+	s.redirect(w, r, r.URL.RequestURI(), remember, url.Values{"prompt": {prompt}})
+}
+
+// checkPrompt verifies the prompt values are known, and none is alone.
+func checkPrompt(prompt string) error {
+	values := strings.Fields(prompt)
+	for _, v := range values {
+		switch v {
+		case "login", "consent", "select_account":
+		case "none":
+			if len(values) > 1 {
+				return fmt.Errorf("invalid prompt %q: none must be alone", prompt)
+			}
+		default:
+			return fmt.Errorf("invalid prompt %q: unknown value %v", prompt, v)
+		}
+	}
+	return nil
+}
+
+// login redirects to the provider, to return to the return parameter after
+// login if it is on the same host, otherwise to Config.PostLoginPath.
+func (s *Auth) login(w http.ResponseWriter, r *http.Request) {
+	target := s.postLoginPath
+	if u, err := url.Parse(r.URL.Query().Get("return")); err == nil {
+		local := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+		if u.Host == "" && u.Scheme == "" || u.String() == s.absURL(r, local.String()) {
+			target = local.String()
+		}
+	}
+	const remember = true
+	s.redirect(w, r, target, remember, nil)
+}
+
+// randomNonce returns a random nonce.
+func randomNonce() string {
+	return hex.EncodeToString(randBytes(20))
+}
+
+// redirect redirects to the provider, to return to target after login, with
+// extra parameters if any.
+func (s *Auth) redirect(w http.ResponseWriter, r *http.Request, target string, remember bool, extra url.Values) {
+	if err := s.checkCookieDomain(r); err != nil {
+		s.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.deleteToken(w, r)
+	redirectURI := s.redirectURI(r)
+	nonce := randomNonce()
+	if s.nonceFunc != nil {
+		nonce = s.nonceFunc()
+	}
+	if s.secret != nil {
+		nonce = s.bindNonce(nonce, redirectURI)
+	}
 	const oneHour = 60 * 60
-	setCookie(w, nonceCookie, nonce, oneHour)
-	u := url.URL{
-		Scheme: "https",
-		Host:   r.Host,
-		Path:   callback,
+	s.setCookie(w, s.nonceCookie, nonce, oneHour, s.nonceSameSite)
+	st := &loginState{Forget: !remember}
+	if isLocalPath(target) {
+		st.Return = target
+	}
+	responseType := "id_token"
+	if s.flow == FlowCode {
+		responseType = "code"
+	}
+	if s.flow == FlowCode && s.usePKCE {
+		st.Verifier = base64.RawURLEncoding.EncodeToString(randBytes(32))
 	}
+	s.setState(w, st)
 	v := url.Values{
-		"response_type": {"id_token"},
+		"response_type": {responseType},
 		"client_id":     {s.clientID},
-		"redirect_uri":  {u.String()},
-		"scope":         {"email"},
+		"redirect_uri":  {redirectURI},
+		"scope":         {s.scope},
 		"nonce":         {nonce},
+		"state":         {nonce},
+	}
+	if len(s.allowedDomains) == 1 {
+		v.Set("hd", s.allowedDomains[0])
+	}
+	if s.formPost {
+		v.Set("response_mode", "form_post")
+	}
+	if s.prompt != "" {
+		v.Set("prompt", s.prompt)
+	}
+	for k, values := range extra {
+		if len(values) > 0 && values[0] != "" {
+			v[k] = values
+		}
+	}
+	if len(s.requiredACR) > 0 {
+		v.Set("acr_values", strings.Join(s.requiredACR, " "))
+	}
+	if s.maxAge > 0 {
+		v.Set("max_age", strconv.Itoa(int(s.maxAge.Seconds())))
+	}
+	if st.Verifier != "" {
+		v.Set("code_challenge", oauth2.S256ChallengeFromVerifier(st.Verifier))
+		v.Set("code_challenge_method", "S256")
 	}
 	authURL := s.provider.Endpoint().AuthURL
 	sep := "?"
 	if strings.Contains(authURL, "?") {
 		sep = "&"
 	}
-	http.Redirect(w, r, authURL+sep+v.Encode(), http.StatusFound)
+	authURL += sep + v.Encode()
+	if s.modifyAuthURL != nil {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("Invalid auth URL: %w", err))
+			return
+		}
+		s.modifyAuthURL(u)
+		authURL = u.String()
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// redirectURI returns the callback URL on the host of the request.
+func (s *Auth) redirectURI(r *http.Request) string {
+	return s.absURL(r, s.callbackPath)
+}
+
+// absURL returns the absolute URL of a local path on the host of the request.
+func (s *Auth) absURL(r *http.Request, path string) string {
+	u, err := url.Parse(path)
+	if err != nil {
+		u = &url.URL{Path: path}
+	}
+	u.Scheme = "https"
+	if s.insecure && !s.isHTTPS(r) {
+		u.Scheme = "http"
+	}
+	u.Host = r.Host
+	if s.hostFunc != nil {
+		u.Scheme, u.Host = s.hostFunc(r)
+	}
+	return u.String()
+}
+
+// sameOrigin returns whether the request comes from our origin, according to
+// its Origin header, or Referer if absent.
+func (s *Auth) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String() == s.absURL(r, "")
+}
+
+// bindNonce binds the nonce to the redirect URI with an HMAC.
+func (s *Auth) bindNonce(nonce, redirectURI string) string {
+	return nonce + "." + hex.EncodeToString(s.mac("nonce", nonce+" "+redirectURI))
+}
+
+// mac authenticates a value with the secret, for a given purpose.
+func (s *Auth) mac(purpose, value string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(purpose + ":" + value))
+	return mac.Sum(nil)
+}
+
+// Handler returns the callback handler, registered by New at
+// Config.CallbackPath, e.g. to mount it on another router.
+func (s *Auth) Handler() http.Handler {
+	return http.HandlerFunc(s.handle)
 }
 
 func (s *Auth) handle(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		fmt.Fprint(w, `<html><body><script>
-let hash = window.location.hash.substr(1);
-let fragments = hash.split('&').reduce((fragments, e) => {
-    let parts = e.split('=');
-    fragments[decodeURIComponent(parts[0])] = decodeURIComponent(parts[1]);
-    return fragments;
-}, {});
-let form = document.createElement('form');
-form.method = 'POST';
-form.action = '`+callback+`';
-let input = document.createElement('input');
-input.type = 'hidden';
-input.name = 'id_token';
-input.value = fragments['id_token'];
-form.appendChild(input);
-document.body.appendChild(form);
-form.submit();
-</script></body></html>`)
+	// In the code flow, the provider redirects to the callback with the code,
+	// and with form_post, it posts to the callback directly.
+	if r.Method == "GET" && s.flow != FlowCode && !s.formPost {
+		s.callbackPage(w, r)
 		return
 	}
+	if q := r.URL.Query(); r.Method == "GET" && q.Get("code") == "" && q.Get("error") == "" {
+		http.Redirect(w, r, s.noFragmentURL(), http.StatusFound)
+		return
+	}
+	if err := s.checkCookieDomain(r); err != nil {
+		s.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// The nonce is single use.
+	if !s.keepNonceOnFailure {
+		s.deleteCookie(w, s.nonceCookie, s.nonceSameSite)
+		s.deleteCookie(w, s.stateCookie, s.nonceSameSite)
+	}
+	if _, err := r.Cookie(s.nonceCookie); err != nil && !s.insecure && !s.isHTTPS(r) {
+		s.error(w, r, http.StatusBadRequest, errors.New("Callback not served over HTTPS: browsers drop secure cookies, "+
+			"serve it over HTTPS or make the reverse proxy set X-Forwarded-Proto"))
+		return
+	}
+	if r.Method == "POST" && s.checkOrigin && !s.sameOrigin(r) {
+		s.error(w, r, http.StatusForbidden, errors.New("Invalid origin"))
+		return
+	}
+	v, err := callbackValues(w, r)
+	if err != nil {
+		s.error(w, r, http.StatusBadRequest, fmt.Errorf("Invalid request: %w", err))
+		return
+	}
+	// The state is the nonce, see Redirect.
+	if state := v.Get("state"); state != "" {
+		if c, err := r.Cookie(s.nonceCookie); err != nil || c.Value != state {
+			s.error(w, r, http.StatusBadRequest, errors.New("Invalid state"))
+			return
+		}
+	}
+	if e := v.Get("error"); e != "" {
+		s.error(w, r, http.StatusUnauthorized, &ProviderError{Code: e, Description: v.Get("error_description")})
+		return
+	}
+	rawIDToken := v.Get("id_token")
+	var token *oauth2.Token
+	if s.flow == FlowCode {
+		rawIDToken, token, err = s.exchange(r, v)
+		if err != nil {
+			s.verifyFailed(r, err)
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("Code exchange failed: %w", err))
+			return
+		}
+	}
 	const skipExpiry = false
-	_, nonce, err := s.verify(r, r.FormValue("id_token"), skipExpiry)
+	idToken, id, err := s.verify(r.Context(), rawIDToken, skipExpiry)
 	if err != nil {
-		http.Error(w, "Invalid ID token: "+err.Error(), http.StatusInternalServerError)
+		s.verifyFailed(r, err)
+		s.error(w, r, http.StatusInternalServerError, fmt.Errorf("%w: %w", ErrInvalidToken, err))
 		return
 	}
-	if c, err := r.Cookie(nonceCookie); err != nil || nonce != c.Value {
-		http.Error(w, "Invalid nonce", http.StatusInternalServerError)
+	// In the hybrid flow a code accompanies the ID token and must be bound to it.
+	if code := v.Get("code"); code != "" && s.flow != FlowCode {
+		if err := verifyCodeHash(rawIDToken, code, idToken); err != nil {
+			s.verifyFailed(r, err)
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+			return
+		}
+	}
+	if err := s.verifyNonce(r, v, idToken); err != nil {
+		s.verifyFailed(r, err)
+		s.error(w, r, http.StatusInternalServerError, fmt.Errorf("%w: %w", ErrInvalidNonce, err))
+		return
+	}
+	if err := s.verifyACR(idToken); err != nil {
+		s.verifyFailed(r, err)
+		s.error(w, r, http.StatusForbidden, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+		return
+	}
+	if err := s.verifyAuthTime(id); err != nil {
+		s.verifyFailed(r, err)
+		s.error(w, r, http.StatusForbidden, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+		return
+	}
+	if s.replayStore != nil {
+		if err := s.verifyReplay(r.Context(), idToken); err != nil {
+			s.verifyFailed(r, err)
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+			return
+		}
+	}
+	sess := &verifiedSession{token: rawIDToken, idToken: idToken, id: id}
+	if s.fetchUserInfo && token != nil && !s.hasProfile(idToken) {
+		if p, err := s.fetchProfile(r, token); err != nil {
+			log.Printf("openid: userinfo: %v", err)
+		} else if p.Subject == idToken.Subject {
+			sess.profile = p
+		}
+	}
+	if s.onFirstLogin != nil {
+		if err := s.firstLogin(sess); err != nil {
+			s.error(w, r, http.StatusForbidden, err)
+			return
+		}
+	}
+	if s.keepNonceOnFailure {
+		s.deleteCookie(w, s.nonceCookie, s.nonceSameSite)
+		s.deleteCookie(w, s.stateCookie, s.nonceSameSite)
+	}
+	st := s.state(r)
+	maxAge := s.sessionMaxAge
+	if st.Forget {
+		maxAge = 0
+		s.setCookie(w, s.sessionCookie, "1", 0, s.tokenSameSite)
+	} else {
+		s.deleteCookie(w, s.sessionCookie, s.tokenSameSite)
+	}
+	if s.sessionStore != nil {
+		if err := s.startSession(w, r, id, maxAge); err != nil {
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("Session store: %w", err))
+			return
+		}
+	}
+	if err := s.setToken(w, r, rawIDToken, maxAge); err != nil {
+		s.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if s.enableRefresh && token != nil && token.RefreshToken != "" {
+		s.setRefreshToken(w, token.RefreshToken, maxAge)
+	}
+	if sess.profile != nil {
+		s.setProfile(w, sess.profile, maxAge)
+	} else if s.fetchUserInfo {
+		s.deleteCookie(w, s.profileCookie, s.tokenSameSite)
+	}
+	target := s.postLoginPath
+	if isLocalPath(st.Return) {
+		target = st.Return
+	}
+	http.Redirect(w, r, target, s.redirectCode)
+}
+
+// firstLogin calls OnFirstLogin if the user is not known yet.
+func (s *Auth) firstLogin(sess *verifiedSession) error {
+	u, err := s.userInfo(sess)
+	if err != nil {
+		return err
+	}
+	ok, err := s.knownUser(u)
+	if err != nil {
+		return fmt.Errorf("known user: %w", err)
+	}
+	if ok {
+		return nil
+	}
+	return s.onFirstLogin(u)
+}
+
+// exchange exchanges the code of the callback for the ID token, also
+// returning the token response, e.g. with the refresh token.
+func (s *Auth) exchange(r *http.Request, v url.Values) (string, *oauth2.Token, error) {
+	code := v.Get("code")
+	if code == "" {
+		return "", nil, errors.New("missing code")
+	}
+	ctx := s.clientContext(r.Context())
+	var opts []oauth2.AuthCodeOption
+	if s.usePKCE {
+		opts = append(opts, oauth2.VerifierOption(s.state(r).Verifier))
+	}
+	if err := s.sem.acquire(ctx); err != nil {
+		return "", nil, err
+	}
+	defer s.sem.release()
+	token, err := s.oauth2Config(r).Exchange(ctx, code, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("no id_token in token response")
+	}
+	return rawIDToken, token, nil
+}
+
+// isHTTPS returns whether the request is effectively over HTTPS, possibly
+// behind a reverse proxy.
+func (s *Auth) isHTTPS(r *http.Request) bool {
+	if s.hostFunc != nil {
+		scheme, _ := s.hostFunc(r)
+		return scheme == "https"
+	}
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// verifyNonce verifies the nonce of the token matches the nonce cookie.
+func (s *Auth) verifyNonce(r *http.Request, v url.Values, idToken *oidc.IDToken) error {
+	nonce := idToken.Nonce
+	if nonce == "" && s.nonceOptional {
+		nonce = v.Get("state")
+	}
+	if s.nonceFunc == nil && !s.wellFormedNonce(nonce) {
+		return fmt.Errorf("%w: %.80q", ErrMalformedNonce, nonce)
+	}
+	c, err := r.Cookie(s.nonceCookie)
+	if err != nil {
+		return errors.New("no nonce cookie")
+	}
+	if nonce != c.Value && !(s.hashedNonce && nonceHash(nonce, c.Value)) {
+		return errors.New("does not match the nonce cookie")
+	}
+	if s.secret != nil {
+		n, _, _ := strings.Cut(c.Value, ".")
+		if !hmac.Equal([]byte(s.bindNonce(n, s.redirectURI(r))), []byte(c.Value)) {
+			return errors.New("nonce not bound to redirect URI")
+		}
+	}
+	return nil
+}
+
+// ErrMalformedNonce is returned when the nonce of the token does not have the
+// format of the generated nonces, e.g. rewritten by the provider.
+var ErrMalformedNonce = errors.New("malformed nonce")
+
+// wellFormedNonce returns whether the nonce of the token has the format of
+// randomNonce, bound if there is a secret, or of its hash with HashedNonce.
+func (s *Auth) wellFormedNonce(nonce string) bool {
+	if s.hashedNonce && (len(nonce) == 64 && isHex(nonce) || len(nonce) == 43 && isBase64URL(nonce)) {
+		return true
+	}
+	n, mac, bound := strings.Cut(nonce, ".")
+	if bound != (s.secret != nil) || bound && (len(mac) != 64 || !isHex(mac)) {
+		return false
+	}
+	return len(n) == 40 && isHex(n)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func isBase64URL(s string) bool {
+	_, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil
+}
+
+// nonceHash returns whether hash is the SHA-256 of the nonce, in hex or
+// base64url as providers differ.
+func nonceHash(hash, nonce string) bool {
+	h := sha256.Sum256([]byte(nonce))
+	return hmac.Equal([]byte(hash), []byte(hex.EncodeToString(h[:]))) ||
+		hmac.Equal([]byte(hash), []byte(base64.RawURLEncoding.EncodeToString(h[:])))
+}
+
+// ReplayStore records token IDs to reject replays.
+type ReplayStore interface {
+	// Seen records the token ID until expiry and returns whether it was
+	// already recorded. It must be safe for concurrent use.
+	Seen(ctx context.Context, id string, expiry time.Time) (bool, error)
+}
+
+// verifyReplay verifies the token ID has not been seen before.
+func (s *Auth) verifyReplay(ctx context.Context, idToken *oidc.IDToken) error {
+	var claims struct {
+		ID string `json:"jti"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("claims: %v", err)
+	}
+	if claims.ID == "" {
+		return errors.New("missing jti")
+	}
+	// Recorded as long as verify accepts the token, with the clock skew.
+	seen, err := s.replayStore.Seen(ctx, claims.ID, idToken.Expiry.Add(s.clockSkew))
+	if err != nil {
+		return err
+	}
+	if seen {
+		return errors.New("token replayed")
+	}
+	return nil
+}
+
+// Logout logs the user out by deleting the cookies, then redirects to
+// Config.PostLogoutRedirect. The user remains logged in at the provider.
+func (s *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	s.endSession(r)
+	s.deleteCookie(w, s.sessionIDCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.profileCookie, s.tokenSameSite)
+	s.deleteToken(w, r)
+	s.deleteCookie(w, s.sessionCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.refreshCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.nonceCookie, s.nonceSameSite)
+	s.deleteCookie(w, s.stateCookie, s.nonceSameSite)
+	http.Redirect(w, r, s.postLogoutRedirect, http.StatusFound)
+}
+
+// LogoutRedirect logs the user out by deleting the cookies, then redirects to
+// the provider to also log out there (RP-initiated logout), which redirects
+// back to Config.PostLogoutRedirect.
+// If the provider does not support it, it is the same as Logout.
+func (s *Auth) LogoutRedirect(w http.ResponseWriter, r *http.Request) {
+	if s.endSessionURL == "" {
+		s.Logout(w, r)
 		return
 	}
-	deleteCookie(w, nonceCookie)
-	const oneYear = 365 * 24 * 60 * 60
-	setCookie(w, tokenCookie, r.FormValue("id_token"), oneYear)
-	http.Redirect(w, r, "/", http.StatusFound)
+	v := url.Values{
+		"client_id":                {s.clientID},
+		"post_logout_redirect_uri": {s.postLogoutRedirect},
+	}
+	if isLocalPath(s.postLogoutRedirect) {
+		v.Set("post_logout_redirect_uri", s.absURL(r, s.postLogoutRedirect))
+	}
+	if token, err := s.rawToken(r); err == nil {
+		v.Set("id_token_hint", token)
+	}
+	s.endSession(r)
+	s.deleteCookie(w, s.sessionIDCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.profileCookie, s.tokenSameSite)
+	s.deleteToken(w, r)
+	s.deleteCookie(w, s.sessionCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.refreshCookie, s.tokenSameSite)
+	s.deleteCookie(w, s.nonceCookie, s.nonceSameSite)
+	s.deleteCookie(w, s.stateCookie, s.nonceSameSite)
+	sep := "?"
+	if strings.Contains(s.endSessionURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, s.endSessionURL+sep+v.Encode(), http.StatusFound)
 }
 
+// isLocalPath returns whether p is a path on the same host.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// ErrNoSession is returned when the user is not logged in yet, e.g. there is
+// no auth token cookie, its token is no longer in Config.Store, or its session
+// was revoked. Errors of a missing cookie also match http.ErrNoCookie.
+var ErrNoSession = errors.New("no auth token cookie")
+
 // User returns the user email after verifying the id token cookie.
+// If the user is not logged in yet, the error matches ErrNoSession.
 func (s *Auth) User(r *http.Request) (string, error) {
-	c, err := r.Cookie(tokenCookie)
+	u, err := s.UserInfo(r)
+	if err != nil {
+		return "", err
+	}
+	return u.Email, nil
+}
+
+// IsUser returns whether the user is logged in with this verified email,
+// compared case-insensitively, after verifying the id token cookie.
+func (s *Auth) IsUser(r *http.Request, email string) bool {
+	id, err := s.Identity(r)
+	if err != nil || !id.EmailVerified {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(id.Email), strings.TrimSpace(email))
+}
+
+// User represents a verified user with more details than Identity.
+type User struct {
+	Identity
+	// Name is the full name, with the profile scope.
+	Name string
+	// Picture is the URL of the profile picture, with the profile scope.
+	Picture string
+	// Raw holds all the claims, to decode provider specific ones.
+	Raw json.RawMessage
+}
+
+// UserInfo returns the user after verifying the id token cookie.
+// It is read from the claims of the token, not the userinfo endpoint, unless
+// obtained at login with Config.FetchUserInfo.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) UserInfo(r *http.Request) (*User, error) {
+	sess, err := s.session(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.userInfo(sess)
+}
+
+func (s *Auth) userInfo(sess *verifiedSession) (*User, error) {
+	u := &User{Identity: sess.id}
+	if err := sess.idToken.Claims(&u.Raw); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(u.Raw, &claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	u.Name, _ = claims[s.nameClaim].(string)
+	u.Picture, _ = claims["picture"].(string)
+	if p := sess.profile; p != nil {
+		if u.Name == "" {
+			u.Name = p.Name
+		}
+		if u.Picture == "" {
+			u.Picture = p.Picture
+		}
+	}
+	return u, nil
+}
+
+// Require is a middleware requiring the user to be authenticated, otherwise
+// it redirects to the provider. The user is stored in the request context,
+// see UserFromContext.
+func (s *Auth) Require(next http.Handler) http.Handler {
+	return s.require(next, s.Redirect)
+}
+
+// RequireAPI is like Require for API endpoints called by scripts, e.g. with
+// fetch: instead of redirecting, it replies 401 Unauthorized with a JSON
+// body {"error": "unauthenticated", "login_url": "..."}, where login_url is
+// set if Config.LoginPath is, to return to the page of the Referer.
+func (s *Auth) RequireAPI(next http.Handler) http.Handler {
+	return s.require(next, s.unauthenticated)
+}
+
+// unauthenticated replies that the API request requires a login.
+func (s *Auth) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	body := map[string]string{"error": "unauthenticated"}
+	if s.loginPath != "" {
+		loginURL := s.loginPath
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+			loginURL += "?" + url.Values{"return": {ref.RequestURI()}}.Encode()
+		}
+		body["login_url"] = loginURL
+	}
+	w.Header().Set("WWW-Authenticate", `OpenIDConnect realm="`+s.absURL(r, "/")+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(body)
+}
+
+// require authenticates the user for next, or calls unauthenticated.
+func (s *Auth) require(next http.Handler, unauthenticated http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.UserInfo(r)
+		var refreshed bool
+		if errors.Is(err, ErrExpired) && s.enableRefresh {
+			var sess *verifiedSession
+			if sess, err = s.refresh(w, r); err == nil {
+				refreshed = true
+				u, err = s.userInfo(sess)
+			}
+		}
+		if err != nil {
+			unauthenticated(w, r)
+			return
+		}
+		// Cookies for the browser session have no expiration to extend.
+		if _, err := r.Cookie(s.sessionCookie); s.slidingSession && err != nil {
+			s.extendSession(w, r, refreshed)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// extendSession extends the cookies of the session together, except the token
+// and refresh token cookies if they were just refreshed.
+func (s *Auth) extendSession(w http.ResponseWriter, r *http.Request, refreshed bool) {
+	names := []string{s.sessionIDCookie, s.profileCookie}
+	if !refreshed {
+		names = append(names, s.refreshCookie)
+		if v, err := s.tokenCookieValue(r); err == nil {
+			s.setTokenCookie(w, r, v, s.sessionMaxAge)
+		}
+		s.extendStoredToken(r)
+	}
+	for _, name := range names {
+		if c, err := r.Cookie(name); err == nil {
+			s.setCookie(w, name, c.Value, s.sessionMaxAge, s.tokenSameSite)
+		}
+	}
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user stored by the Require middleware, without
+// verifying again.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	u, ok := ctx.Value(userKey{}).(*User)
+	return u, ok
+}
+
+// Identity represents a verified user.
+type Identity struct {
+	// Issuer and Subject uniquely identify the user, e.g. to key accounts.
+	Issuer  string
+	Subject string
+	// Email is for display, it may change or be reassigned.
+	Email string
+	// EmailVerified is the email_verified claim (or Config.EmailVerifiedClaim),
+	// always set, e.g. to record it; false only with AllowUnverifiedEmail.
+	EmailVerified bool
+	// AuthTime is when the user last authenticated at the provider, if known,
+	// independently of the session, e.g. to require a recent authentication.
+	AuthTime time.Time
+}
+
+// Identity returns the user identity after verifying the id token cookie.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) Identity(r *http.Request) (Identity, error) {
+	sess, err := s.session(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	return sess.id, nil
+}
+
+// Claims unmarshals all the claims of the token after verifying the id token
+// cookie, e.g. name and picture with the profile scope.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) Claims(r *http.Request, v interface{}) error {
+	sess, err := s.session(r)
+	if err != nil {
+		return err
+	}
+	return sess.idToken.Claims(v)
+}
+
+// Claim returns a claim of the token after verifying the id token cookie,
+// by its full name, e.g. https://example.com/roles for a namespaced claim.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) Claim(r *http.Request, name string) (interface{}, error) {
+	var claims map[string]interface{}
+	if err := s.Claims(r, &claims); err != nil {
+		return nil, err
+	}
+	v, ok := claims[name]
+	if !ok {
+		return nil, fmt.Errorf("no claim %v", name)
+	}
+	return v, nil
+}
+
+// Token returns the raw ID token after verifying the id token cookie, e.g. to
+// forward it to another API as bearer token.
+// The cookie is HttpOnly so that JavaScript cannot read the token: serving it
+// to JavaScript gives up this protection, as any XSS can then steal it.
+// If the user is not logged in yet, the error matches ErrNoSession.
+func (s *Auth) Token(r *http.Request) (string, error) {
+	sess, err := s.session(r)
 	if err != nil {
-		return "", fmt.Errorf("no auth token cookie")
+		return "", err
 	}
-	const skipExpiry = true
-	email, _, err := s.verify(r, c.Value, skipExpiry)
+	return sess.token, nil
+}
+
+// verifiedSession is a session verified from the id token cookie.
+type verifiedSession struct {
+	token   string
+	idToken *oidc.IDToken
+	id      Identity
+	profile *profile // with FetchUserInfo, if the token lacks it
+}
+
+// session verifies the id token cookie.
+func (s *Auth) session(r *http.Request) (*verifiedSession, error) {
+	token, err := s.rawToken(r)
+	if err != nil {
+		return nil, err
+	}
+	skipExpiry := !s.enforceExpiry
+	idToken, id, err := s.verify(r.Context(), token, skipExpiry)
 	if err != nil {
-		return "", fmt.Errorf("invalid ID token: %v", err)
+		s.verifyFailed(r, err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if s.sessionStore != nil {
+		if err := s.checkSession(r, id); err != nil {
+			return nil, err
+		}
+	}
+	sess := &verifiedSession{token: token, idToken: idToken, id: id}
+	if s.fetchUserInfo {
+		sess.profile = s.profile(r, idToken.Subject)
 	}
-	return email, nil
+	return sess, nil
 }
 
-func (s *Auth) verify(r *http.Request, token string, skipExpiry bool) (string, string, error) {
-	config := &oidc.Config{ClientID: s.clientID}
-	if skipExpiry {
-		config.SkipExpiryCheck = true
+// maxCallbackSize limits the size of the body posted to the callback.
+const maxCallbackSize = 1 << 20
+
+// callbackValues returns the values posted to the callback, either form
+// encoded or as a JSON object, e.g. {"id_token": "..."} from fetch clients.
+func callbackValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCallbackSize)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.Form, nil
+	}
+	var m map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	for k, e := range m {
+		v.Set(k, e)
+	}
+	return v, nil
+}
+
+// verifyFailed reports a verification failure with the client IP.
+func (s *Auth) verifyFailed(r *http.Request, err error) {
+	if s.onVerifyFailure == nil {
+		return
 	}
-	idToken, err := s.provider.Verifier(config).Verify(r.Context(), token)
+	s.onVerifyFailure(remoteIP(r), err)
+}
+
+// remoteIP returns the IP address of the client.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// VerifyToken verifies an ID token, including its expiry, and returns it for
+// advanced uses, e.g. to decode other claims.
+func (s *Auth) VerifyToken(ctx context.Context, token string) (*oidc.IDToken, error) {
+	const skipExpiry = false
+	idToken, _, err := s.verify(ctx, token, skipExpiry)
+	return idToken, err
+}
+
+func (s *Auth) verify(ctx context.Context, token string, skipExpiry bool) (*oidc.IDToken, Identity, error) {
+	idToken, err := s.verifier.Verify(ctx, token)
 	if err != nil {
-		return "", "", err
+		return nil, Identity{}, err
+	}
+	if !skipExpiry && idToken.Expiry.Before(s.now().Add(-s.clockSkew)) {
+		return nil, Identity{}, fmt.Errorf("%w at %v", ErrExpired, idToken.Expiry)
+	}
+	// Skipping the expiry check of the verifier also skips the nbf check.
+	var notBefore struct {
+		NBF float64 `json:"nbf"`
+	}
+	if err := idToken.Claims(&notBefore); err != nil {
+		return nil, Identity{}, fmt.Errorf("claims: %v", err)
+	}
+	if nbf := time.Unix(int64(notBefore.NBF), 0); notBefore.NBF != 0 && nbf.After(s.now().Add(s.clockSkew)) {
+		return nil, Identity{}, fmt.Errorf("token not valid before %v", nbf)
+	}
+	if !slices.ContainsFunc(idToken.Audience, func(aud string) bool { return slices.Contains(s.clientIDs, aud) }) {
+		return nil, Identity{}, fmt.Errorf("%w: %v", ErrAudienceMismatch, idToken.Audience)
+	}
+	if s.singleAudience && len(idToken.Audience) != 1 {
+		return nil, Identity{}, fmt.Errorf("multiple audiences: %v", idToken.Audience)
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, Identity{}, fmt.Errorf("claims: %v", err)
+	}
+	if azp, _ := claims["azp"].(string); s.verifyAzp && len(idToken.Audience) > 1 && !slices.Contains(s.clientIDs, azp) {
+		return nil, Identity{}, fmt.Errorf("%w: authorized party %q with audiences %v", ErrAudienceMismatch, azp, idToken.Audience)
+	}
+	id := Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		EmailVerified: claimBool(claims, s.emailVerifiedClaim),
+	}
+	id.Email, _ = claims[s.emailClaim].(string)
+	if s.subjectClaim != "" {
+		id.Subject, _ = claims[s.subjectClaim].(string)
+		if id.Subject == "" {
+			return nil, Identity{}, fmt.Errorf("missing subject claim %v", s.subjectClaim)
+		}
+	}
+	if authTime, ok := claims["auth_time"].(float64); ok {
+		id.AuthTime = time.Unix(int64(authTime), 0)
+	}
+	if !id.EmailVerified && (!s.allowUnverified || len(s.allowedDomains) > 0) {
+		return nil, Identity{}, fmt.Errorf("%w: %v", ErrEmailNotVerified, id.Email)
+	}
+	// Google sets hd to the domain of Workspace users.
+	if hd, _ := claims["hd"].(string); hd != "" && !strings.EqualFold(emailDomain(id.Email), hd) {
+		return nil, Identity{}, fmt.Errorf("email %v does not match hosted domain %v", id.Email, hd)
+	}
+	if len(s.allowedDomains) > 0 && !s.allowedDomain(id.Email) {
+		return nil, Identity{}, fmt.Errorf("%w: %v", ErrDomainNotAllowed, id.Email)
+	}
+	if len(s.requiredScopes) > 0 {
+		granted := map[string]bool{}
+		for _, scope := range scopes(claims) {
+			granted[scope] = true
+		}
+		for _, scope := range s.requiredScopes {
+			if !granted[scope] {
+				return nil, Identity{}, fmt.Errorf("%w: %v", ErrMissingScope, scope)
+			}
+		}
+	}
+	return idToken, id, nil
+}
+
+// claimBool returns a boolean claim, also accepted as a string (e.g. Apple).
+func claimBool(claims map[string]interface{}, name string) bool {
+	switch v := claims[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// ProviderError is returned to the ErrorHandler when the provider fails the
+// login, e.g. with Code login_required for prompt none without a session at
+// the provider, or access_denied if the user declined.
+type ProviderError struct {
+	Code        string
+	Description string
+}
+
+func (e *ProviderError) Error() string {
+	if e.Description != "" {
+		return "Login failed at the provider: " + e.Description
+	}
+	return "Login failed at the provider: " + e.Code
+}
+
+// ErrInvalidToken is returned when the ID token fails verification, e.g. to
+// the ErrorHandler by the callback, or by User.
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// ErrInvalidNonce is returned to the ErrorHandler when the nonce of the ID
+// token does not match the nonce cookie.
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+// ErrExpired is returned when the token is expired, e.g. by User with
+// Config.EnforceExpiryInUser: log in again to renew it.
+var ErrExpired = errors.New("token expired")
+
+// ErrEmailNotVerified is returned when the email of the token is not verified,
+// e.g. to OnVerifyFailure to record near-misses.
+var ErrEmailNotVerified = errors.New("email not verified")
+
+// ErrMissingScope is returned when the token lacks one of Config.RequiredScopes.
+var ErrMissingScope = errors.New("missing required scope")
+
+// ErrACRNotSatisfied is returned when the acr claim of the token is not one of
+// Config.RequiredACR.
+var ErrACRNotSatisfied = errors.New("authentication context not satisfied")
+
+// verifyACR verifies the acr claim is one of the required values, if any.
+func (s *Auth) verifyACR(idToken *oidc.IDToken) error {
+	if len(s.requiredACR) == 0 {
+		return nil
 	}
 	var claims struct {
-		Email         string `json:"email"`
-		EmailVerified bool   `json:"email_verified"`
+		ACR string `json:"acr"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
-		return "", "", fmt.Errorf("claims: %v", err)
+		return err
+	}
+	if !slices.Contains(s.requiredACR, claims.ACR) {
+		return fmt.Errorf("%w: acr %q", ErrACRNotSatisfied, claims.ACR)
+	}
+	return nil
+}
+
+// ErrAuthTooOld is returned when the user authenticated at the provider longer
+// than Config.MaxAge ago: Redirect again to authenticate.
+var ErrAuthTooOld = errors.New("authentication too old")
+
+// verifyAuthTime verifies the user authenticated within MaxAge, if set.
+func (s *Auth) verifyAuthTime(id Identity) error {
+	if s.maxAge <= 0 {
+		return nil
 	}
-	if !claims.EmailVerified {
-		return "", "", fmt.Errorf("email not verified: %v", claims.Email)
+	if id.AuthTime.IsZero() {
+		return fmt.Errorf("%w: missing auth_time", ErrAuthTooOld)
 	}
-	return claims.Email, idToken.Nonce, nil
+	if age := s.now().Sub(id.AuthTime); age > s.maxAge+s.clockSkew {
+		return fmt.Errorf("%w: %v ago", ErrAuthTooOld, age.Round(time.Second))
+	}
+	return nil
 }
 
-func setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+// ErrDomainNotAllowed is returned when the email domain is not one of
+// Config.AllowedDomains.
+var ErrDomainNotAllowed = errors.New("email domain not allowed")
+
+// allowedDomain returns whether the domain of the email is allowed.
+func (s *Auth) allowedDomain(email string) bool {
+	domain := emailDomain(email)
+	if domain == "" {
+		return false
+	}
+	for _, d := range s.allowedDomains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailDomain returns the domain of the email, after the last @.
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return email[i+1:]
+}
+
+// ErrAudienceMismatch is returned when the token was issued for another client,
+// e.g. a session from before a change of Config.ClientID. Logging in again
+// replaces it, as Require does.
+var ErrAudienceMismatch = errors.New("token issued for another client ID")
+
+// scopes returns the scopes granted in the claims, either as a space-separated
+// string or a list, in the scope or scp claim.
+func scopes(claims map[string]interface{}) []string {
+	var r []string
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			r = append(r, strings.Fields(v)...)
+		case []interface{}:
+			for _, e := range v {
+				if scope, ok := e.(string); ok {
+					r = append(r, scope)
+				}
+			}
+		}
+	}
+	return r
+}
+
+// verifyCodeHash verifies the c_hash claim of the ID token matches the code.
+// See https://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+func verifyCodeHash(token, code string, idToken *oidc.IDToken) error {
+	var claims struct {
+		CodeHash string `json:"c_hash"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("claims: %v", err)
+	}
+	if claims.CodeHash == "" {
+		return fmt.Errorf("missing c_hash")
+	}
+	h, err := tokenHash(token)
+	if err != nil {
+		return err
+	}
+	h.Write([]byte(code))
+	sum := h.Sum(nil)
+	if base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]) != claims.CodeHash {
+		return fmt.Errorf("c_hash does not match code")
+	}
+	return nil
+}
+
+// tokenHash returns the hash matching the signature algorithm of the token.
+func tokenHash(token string) (hash.Hash, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.SplitN(token, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	switch header.Alg {
+	case oidc.RS256, oidc.ES256, oidc.PS256:
+		return sha256.New(), nil
+	case oidc.RS384, oidc.ES384, oidc.PS384:
+		return sha512.New384(), nil
+	case oidc.RS512, oidc.ES512, oidc.PS512, oidc.EdDSA:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm: %v", header.Alg)
+}
+
+func (s *Auth) setCookie(w http.ResponseWriter, name, value string, maxAge int, sameSite http.SameSite) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     name,
 		Value:    value,
 		Path:     "/",
+		Domain:   s.cookieDomain,
 		MaxAge:   maxAge,
-		Secure:   true,
+		Secure:   !s.insecure,
 		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+		SameSite: sameSite,
 	})
 }
 
-func deleteCookie(w http.ResponseWriter, name string) {
-	setCookie(w, name, "", -1)
+// checkCookieDomain verifies the host of the request is within the cookie
+// domain, if any, as browsers would reject the cookies.
+func (s *Auth) checkCookieDomain(r *http.Request) error {
+	if s.cookieDomain == "" {
+		return nil
+	}
+	u, err := url.Parse(s.absURL(r, ""))
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	if host != s.cookieDomain && !strings.HasSuffix(host, "."+s.cookieDomain) {
+		return fmt.Errorf("host %v not within CookieDomain %v", host, s.cookieDomain)
+	}
+	return nil
+}
+
+func (s *Auth) deleteCookie(w http.ResponseWriter, name string, sameSite http.SameSite) {
+	s.setCookie(w, name, "", -1, sameSite)
 }
 
 func randBytes(length int) []byte {
@@ -1,6 +1,7 @@
 package openid20_test
 
 import (
+        "encoding/json"
         "fmt"
         "net/http"
 
@@ -23,3 +24,18 @@ func ExampleVerify() {
         })
 
 }
+
+func ExampleVerifier_Handler() {
+        const endpoint = "https://steamcommunity.com/openid/login"
+        v := &openid20.Verifier{
+                Endpoint: endpoint,
+                ErrorHandler: func(w http.ResponseWriter, r *http.Request, status int, err error) {
+                        w.Header().Set("Content-Type", "application/json")
+                        w.WriteHeader(status)
+                        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+                },
+        }
+        http.Handle("/auth", v.Handler(func(w http.ResponseWriter, r *http.Request, user string) {
+                fmt.Fprintf(w, "hello %v", user)
+        }))
+}
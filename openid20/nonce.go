@@ -0,0 +1,47 @@
+package openid20
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+// NonceStore records response nonces to reject replays.
+type NonceStore interface {
+  // Seen records the nonce until expiry and returns whether it was already
+  // recorded. It must be safe for concurrent use.
+  Seen(ctx context.Context, nonce string, expiry time.Time) (bool, error)
+}
+
+// MemoryNonceStore is a NonceStore in memory, for a single server.
+// Nonces are dropped once expired to bound memory.
+type MemoryNonceStore struct {
+  mu        sync.Mutex
+  nonces    map[string]time.Time
+  nextSweep time.Time
+}
+
+// NewMemoryNonceStore creates a new in-memory nonce store.
+func NewMemoryNonceStore() *MemoryNonceStore {
+  return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+// Seen implements NonceStore.
+func (s *MemoryNonceStore) Seen(ctx context.Context, nonce string, expiry time.Time) (bool, error) {
+  now := time.Now()
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if now.After(s.nextSweep) {
+    for k, e := range s.nonces {
+      if now.After(e) {
+        delete(s.nonces, k)
+      }
+    }
+    s.nextSweep = now.Add(maxNonceAge)
+  }
+  if e, ok := s.nonces[nonce]; ok && !now.After(e) {
+    return true, nil
+  }
+  s.nonces[nonce] = expiry
+  return false, nil
+}
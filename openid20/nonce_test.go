@@ -0,0 +1,36 @@
+package openid20
+
+import (
+  "context"
+  "strconv"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func BenchmarkMemoryNonceStore(b *testing.B) {
+  s := NewMemoryNonceStore()
+  ctx := context.Background()
+  expiry := time.Now().Add(maxNonceAge)
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := s.Seen(ctx, strconv.Itoa(i), expiry); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkMemoryNonceStoreParallel(b *testing.B) {
+  s := NewMemoryNonceStore()
+  ctx := context.Background()
+  expiry := time.Now().Add(maxNonceAge)
+  var n atomic.Int64
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    for pb.Next() {
+      if _, err := s.Seen(ctx, strconv.FormatInt(n.Add(1), 10), expiry); err != nil {
+        b.Fatal(err)
+      }
+    }
+  })
+}
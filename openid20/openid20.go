@@ -5,10 +5,11 @@ Open ID 2.0 is obsolete and replaced by OpenID Connect but some providers still
 use it, e.g. Steam.
 
 Simplification choices of this library:
-- it does not verify nonce reuse
+- it does not verify nonce reuse by default
   - the spec requires it but it's a terrible stateful idea requiring storage
   - you can replay identification, not a problem unless the return URL leaks
   - they expire after 1 minute anyway
+  - if you want it anyway, use a Verifier with a NonceStore
 - it does not verify discover information
   - we're only using openid.claimed_id property
   - spec says we should verify it can assert it, but it's the basic one
@@ -17,6 +18,9 @@ Simplification choices of this library:
 - it does not verify return_to scheme matches
   - because server itself doesn't know, e.g. if behind a reverse proxy
   - it's signed by the openid server anyway
+- it relies on the server to verify the signature (check_authentication)
+  - the association type is not reported in this stateless mode
+  - a Verifier can restrict the algorithm, deduced from the signature length
 
 Another potential problem with Open ID 2.0 spec is login xsrf, but it's easy
 enough to mitigate in applications, if that's something you're concerned about:
@@ -28,6 +32,7 @@ For a spec compliant but heavier library see https://github.com/yohcop/openid-go
 package openid20
 
 import (
+  "encoding/base64"
   "errors"
   "fmt"
   "io/ioutil"
@@ -63,22 +68,140 @@ func realm(uri string) string {
 }
 
 // Verify verifies the return URL after a login and returns the openid.claimed_id.
-func Verify(r *http.Request, endpoint string) (string, error) {
+// The signed openid.op_endpoint must be endpoint or one of allowed, for apps
+// accepting several providers. Only the signed endpoint is contacted to verify
+// the assertion, so a forged callback cannot point to a server of its choice.
+// With allowed endpoints, the claimed ID must be on the host of the signed
+// endpoint, so that a provider cannot assert IDs of users of another.
+func Verify(r *http.Request, endpoint string, allowed ...string) (string, error) {
+  v := &Verifier{Endpoint: endpoint, Allowed: allowed}
+  return v.Verify(r)
+}
+
+// Signature algorithms of Open ID 2.0 associations.
+const (
+  HMACSHA1   = "HMAC-SHA1"
+  HMACSHA256 = "HMAC-SHA256"
+)
+
+// Verifier verifies return URLs like Verify, with additional policies.
+type Verifier struct {
+  // Endpoint is the provider endpoint, see Verify.
+  Endpoint string
+  // Allowed are other accepted endpoints, see Verify.
+  Allowed []string
+  // Fallbacks are mirrors of an endpoint, keyed by it, contacted in order to
+  // verify an assertion if the endpoint cannot be reached. They must be of
+  // the same provider: an assertion is never sent to another endpoint.
+  Fallbacks map[string][]string
+  // Algorithms are the accepted signature algorithms, e.g. only HMACSHA256
+  // to reject the weaker HMACSHA1. As the association type is not reported,
+  // the algorithm is deduced from the signature length. Defaults to any.
+  Algorithms []string
+  // NonceStore, if set, records the response nonces to reject replays.
+  NonceStore NonceStore
+  // Limit, if set, limits the concurrent check_authentication calls to its
+  // capacity, e.g. make(chan struct{}, 10) shared by verifiers. Calls wait
+  // until the request context is done.
+  Limit chan struct{}
+  // ErrorHandler replies to verification errors of Handler, e.g. in JSON.
+  // Defaults to plain text with status 403 Forbidden, like http.Error.
+  ErrorHandler func(w http.ResponseWriter, r *http.Request, status int, err error)
+  // HTTPClient makes the check_authentication calls, e.g. with a timeout or
+  // tracing. Defaults to http.DefaultClient.
+  HTTPClient *http.Client
+}
+
+// Handler returns a handler for the return URL which verifies it and calls
+// next with the openid.claimed_id, or the error handler on failure.
+func (s *Verifier) Handler(next func(w http.ResponseWriter, r *http.Request, claimedID string)) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    claimedID, err := s.Verify(r)
+    if err != nil {
+      if s.ErrorHandler != nil {
+        s.ErrorHandler(w, r, http.StatusForbidden, err)
+        return
+      }
+      http.Error(w, err.Error(), http.StatusForbidden)
+      return
+    }
+    next(w, r, claimedID)
+  })
+}
+
+// Verify verifies the return URL after a login and returns the openid.claimed_id.
+func (s *Verifier) Verify(r *http.Request) (string, error) {
   if err := verifySignedFields(r); err != nil {
     return "", err
   }
-  if err := verifySignature(r, endpoint); err != nil {
+  if err := s.verifyAlgorithm(r); err != nil {
+    return "", err
+  }
+  if s.Limit != nil {
+    select {
+    case s.Limit <- struct{}{}:
+      defer func() { <-s.Limit }()
+    case <-r.Context().Done():
+      return "", r.Context().Err()
+    }
+  }
+  client := s.HTTPClient
+  if client == nil {
+    client = http.DefaultClient
+  }
+  if err := verifySignature(r, client, append([]string{s.Endpoint}, s.Allowed...), s.Fallbacks); err != nil {
     return "", err
   }
+  if len(s.Allowed) > 0 {
+    if err := verifyClaimedID(r); err != nil {
+      return "", err
+    }
+  }
   if err := verifyReturnTo(r); err != nil {
     return "", err
   }
-  if err := verifyNonce(r); err != nil {
+  ts, err := verifyNonce(r)
+  if err != nil {
     return "", err
   }
+  if s.NonceStore != nil {
+    v := r.URL.Query()
+    // Nonces are unique per endpoint.
+    nonce := v.Get("openid.op_endpoint") + " " + v.Get("openid.response_nonce")
+    seen, err := s.NonceStore.Seen(r.Context(), nonce, ts.Add(maxNonceAge))
+    if err != nil {
+      return "", fmt.Errorf("nonce store: %v", err)
+    }
+    if seen {
+      return "", errors.New("nonce already used")
+    }
+  }
   return r.URL.Query().Get("openid.claimed_id"), nil
 }
 
+func (s *Verifier) verifyAlgorithm(r *http.Request) error {
+  if len(s.Algorithms) == 0 {
+    return nil
+  }
+  sig, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("openid.sig"))
+  if err != nil {
+    return fmt.Errorf("invalid signature: %v", err)
+  }
+  var alg string
+  switch len(sig) {
+  case 20:
+    alg = HMACSHA1
+  case 32:
+    alg = HMACSHA256
+  default:
+    return fmt.Errorf("unknown signature algorithm of %d bytes", len(sig))
+  }
+  if !contains(s.Algorithms, alg) {
+    return fmt.Errorf("signature algorithm not allowed: %v", alg)
+  }
+  return nil
+}
+
 func verifySignedFields(r *http.Request) error {
   v := r.URL.Query()
   ok := map[string]bool{
@@ -101,9 +224,9 @@ func verifySignedFields(r *http.Request) error {
   return nil
 }
 
-func verifySignature(r *http.Request, endpoint string) error {
+func verifySignature(r *http.Request, client *http.Client, endpoints []string, fallbacks map[string][]string) error {
   v := r.URL.Query()
-  if got := v.Get("openid.op_endpoint"); got != endpoint {
+  if got := v.Get("openid.op_endpoint"); !contains(endpoints, got) {
     return fmt.Errorf("unexpected endpoint: %v", got)
   }
   params := url.Values{}
@@ -116,18 +239,20 @@ func verifySignature(r *http.Request, endpoint string) error {
       params.Add(k, e)
     }
   }
-  resp, err := http.PostForm(v.Get("openid.op_endpoint"), params)
-  if err != nil {
-    return err
+  op := v.Get("openid.op_endpoint")
+  content, err := checkAuthentication(r, client, op, params)
+  for _, endpoint := range fallbacks[op] {
+    if err == nil {
+      break
+    }
+    content, err = checkAuthentication(r, client, endpoint, params)
   }
-  defer resp.Body.Close()
-  content, err := ioutil.ReadAll(resp.Body)
   if err != nil {
     return err
   }
   isValid := false
   nsValid := false
-  for _, l := range strings.Split(string(content), "\n") {
+  for _, l := range strings.Split(content, "\n") {
     if l == "is_valid:true" {
       isValid = true
     } else if l == "ns:http://specs.openid.net/auth/2.0" {
@@ -140,6 +265,54 @@ func verifySignature(r *http.Request, endpoint string) error {
   return nil
 }
 
+// verifyClaimedID verifies the claimed ID is on the host of the endpoint which
+// vouched for it.
+func verifyClaimedID(r *http.Request) error {
+  v := r.URL.Query()
+  endpoint, err := url.Parse(v.Get("openid.op_endpoint"))
+  if err != nil {
+    return err
+  }
+  claimedID, err := url.Parse(v.Get("openid.claimed_id"))
+  if err != nil {
+    return err
+  }
+  if !strings.EqualFold(claimedID.Host, endpoint.Host) {
+    return fmt.Errorf("claimed ID %v not asserted by its provider: %v", claimedID, endpoint)
+  }
+  return nil
+}
+
+func checkAuthentication(r *http.Request, client *http.Client, endpoint string, params url.Values) (string, error) {
+  req, err := http.NewRequestWithContext(r.Context(), "POST", endpoint, strings.NewReader(params.Encode()))
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  resp, err := client.Do(req)
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("%v: %v", endpoint, resp.Status)
+  }
+  content, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return "", err
+  }
+  return string(content), nil
+}
+
+func contains(list []string, s string) bool {
+  for _, e := range list {
+    if e == s {
+      return true
+    }
+  }
+  return false
+}
+
 func verifyReturnTo(r *http.Request) error {
   v := r.URL.Query()
   returnTo, err := url.Parse(v.Get("openid.return_to"))
@@ -162,18 +335,22 @@ func verifyReturnTo(r *http.Request) error {
   return nil
 }
 
-func verifyNonce(r *http.Request) error {
+// maxNonceAge is how long a response nonce is accepted.
+const maxNonceAge = time.Minute
+
+// verifyNonce verifies the response nonce is fresh and returns its time.
+func verifyNonce(r *http.Request) (time.Time, error) {
   nonce := r.URL.Query().Get("openid.response_nonce")
   if len(nonce) < 20 || len(nonce) > 256 {
-    return errors.New("invalid nonce")
+    return time.Time{}, errors.New("invalid nonce")
   }
   ts, err := time.Parse(time.RFC3339, nonce[:20])
   if err != nil {
-    return err
+    return time.Time{}, err
   }
-  if ts.Add(time.Minute).Before(time.Now()) {
-    return fmt.Errorf("nonce too old: %v", ts)
+  if ts.Add(maxNonceAge).Before(time.Now()) {
+    return time.Time{}, fmt.Errorf("nonce too old: %v", ts)
   }
-  // note: by choice, not verifying nonce reuse
-  return nil
+  // note: reuse is only verified with a NonceStore
+  return ts, nil
 }
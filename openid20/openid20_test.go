@@ -0,0 +1,98 @@
+package openid20
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// newEndpoint serves check_authentication, valid or failing, and counts calls.
+func newEndpoint(t *testing.T, valid bool) (*httptest.Server, *atomic.Int32) {
+  var calls atomic.Int32
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls.Add(1)
+    if !valid {
+      http.Error(w, "unavailable", http.StatusServiceUnavailable)
+      return
+    }
+    w.Write([]byte("ns:http://specs.openid.net/auth/2.0\nis_valid:true\n"))
+  }))
+  t.Cleanup(srv.Close)
+  return srv, &calls
+}
+
+// assertion returns a return URL request asserting claimedID from endpoint.
+func assertion(endpoint, claimedID string) *http.Request {
+  returnTo := "https://app.example/return"
+  v := url.Values{
+    "openid.ns":             {"http://specs.openid.net/auth/2.0"},
+    "openid.mode":           {"id_res"},
+    "openid.op_endpoint":    {endpoint},
+    "openid.claimed_id":     {claimedID},
+    "openid.identity":       {claimedID},
+    "openid.return_to":      {returnTo},
+    "openid.response_nonce": {time.Now().UTC().Format(time.RFC3339) + "abc"},
+    "openid.assoc_handle":   {"handle"},
+    "openid.signed":         {"signed,op_endpoint,claimed_id,identity,return_to,response_nonce,assoc_handle"},
+    "openid.sig":            {"c2lnbmF0dXJlc2lnbmF0dXJlc2k="},
+  }
+  return httptest.NewRequest("GET", returnTo+"?"+v.Encode(), nil)
+}
+
+func TestVerifyFallbacks(t *testing.T) {
+  down, downCalls := newEndpoint(t, false)
+  mirror, mirrorCalls := newEndpoint(t, true)
+  other, otherCalls := newEndpoint(t, true)
+  claimedID := down.URL + "/id/1"
+
+  v := &Verifier{Endpoint: down.URL, Allowed: []string{other.URL}}
+  if _, err := v.Verify(assertion(down.URL, claimedID)); err == nil {
+    t.Error("Verify without fallback: got nil error")
+  }
+  if n := otherCalls.Load(); n != 0 {
+    t.Errorf("other provider contacted %d times, want 0", n)
+  }
+
+  v.Fallbacks = map[string][]string{down.URL: {mirror.URL}}
+  got, err := v.Verify(assertion(down.URL, claimedID))
+  if err != nil {
+    t.Fatalf("Verify with fallback: %v", err)
+  }
+  if got != claimedID {
+    t.Errorf("Verify: got %q, want %q", got, claimedID)
+  }
+  if downCalls.Load() != 2 || mirrorCalls.Load() != 1 || otherCalls.Load() != 0 {
+    t.Errorf("calls: endpoint %d, mirror %d, other %d; want 2, 1, 0",
+      downCalls.Load(), mirrorCalls.Load(), otherCalls.Load())
+  }
+}
+
+func TestVerifyClaimedIDHost(t *testing.T) {
+  a, _ := newEndpoint(t, true)
+  b, _ := newEndpoint(t, true)
+  v := &Verifier{Endpoint: a.URL, Allowed: []string{b.URL}}
+  if _, err := v.Verify(assertion(b.URL, "https://steamcommunity.com/openid/id/1")); err == nil {
+    t.Error("Verify of a claimed ID of another provider: got nil error")
+  }
+  if _, err := v.Verify(assertion(b.URL, b.URL+"/id/1")); err != nil {
+    t.Errorf("Verify: %v", err)
+  }
+}
+
+func TestVerifyHTTPClient(t *testing.T) {
+  srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("ns:http://specs.openid.net/auth/2.0\nis_valid:true\n"))
+  }))
+  defer srv.Close()
+  v := &Verifier{Endpoint: srv.URL}
+  if _, err := v.Verify(assertion(srv.URL, srv.URL+"/id/1")); err == nil {
+    t.Error("Verify with the default client not trusting the endpoint: got nil error")
+  }
+  v.HTTPClient = srv.Client()
+  if _, err := v.Verify(assertion(srv.URL, srv.URL+"/id/1")); err != nil {
+    t.Errorf("Verify: %v", err)
+  }
+}
@@ -0,0 +1,133 @@
+package openid
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScope(t *testing.T) {
+	for _, tt := range []struct {
+		scopes []string
+		flow   Flow
+		want   string
+	}{
+		{flow: FlowImplicit, want: "email"},
+		{flow: FlowCode, want: "openid email"},
+		{scopes: []string{"profile"}, flow: FlowImplicit, want: "openid email profile"},
+		{scopes: []string{"email", "profile", "openid"}, flow: FlowCode, want: "openid email profile"},
+	} {
+		if got := scope(tt.scopes, tt.flow); got != tt.want {
+			t.Errorf("scope(%v, %v): got %q, want %q", tt.scopes, tt.flow, got, tt.want)
+		}
+	}
+}
+
+func TestSlidingSession(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{SlidingSession: true, SessionDuration: time.Hour})
+	r := httptest.NewRequest("GET", "https://app.example/", nil)
+	for name, value := range map[string]string{
+		auth.tokenCookie:     sign(nil),
+		auth.sessionIDCookie: "id",
+		auth.refreshCookie:   "refresh",
+		auth.profileCookie:   "profile",
+	} {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	w := httptest.NewRecorder()
+	auth.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	got := map[string]int{}
+	for _, c := range w.Result().Cookies() {
+		got[c.Name] = c.MaxAge
+	}
+	for _, name := range []string{auth.tokenCookie, auth.sessionIDCookie, auth.refreshCookie, auth.profileCookie} {
+		if got[name] != 3600 {
+			t.Errorf("cookie %v: got max age %v, want 3600", name, got[name])
+		}
+	}
+}
+
+func TestNewNonceSameSite(t *testing.T) {
+	srv, _ := newSigningProvider(t)
+	for _, tt := range []struct {
+		config Config
+		ok     bool
+	}{
+		{config: Config{SameSite: http.SameSiteStrictMode}, ok: true},
+		{config: Config{SameSite: http.SameSiteStrictMode, Flow: FlowCode}},
+		{config: Config{SameSite: http.SameSiteStrictMode, Flow: FlowCode, NonceSameSite: http.SameSiteLaxMode}, ok: true},
+		{config: Config{NonceSameSite: http.SameSiteStrictMode, ResponseMode: "form_post"}},
+		{config: Config{NonceSameSite: http.SameSiteLaxMode, ResponseMode: "form_post"}},
+		{config: Config{ResponseMode: "form_post"}, ok: true},
+	} {
+		c := tt.config
+		c.Provider = srv.URL
+		c.ClientID = "client"
+		c.ClientSecret = "secret"
+		c.HTTPClient = srv.Client()
+		c.Mux = http.NewServeMux()
+		auth, err := New(context.Background(), &c)
+		if err == nil {
+			auth.Close()
+		}
+		if got := err == nil; got != tt.ok {
+			t.Errorf("New(flow %v, SameSite %v, NonceSameSite %v, ResponseMode %q): got error %v",
+				c.Flow, c.SameSite, c.NonceSameSite, c.ResponseMode, err)
+		}
+	}
+}
+
+func TestErrorHook(t *testing.T) {
+	srv, _ := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{
+		ErrorTemplate: template.Must(template.New("error").Parse("error page {{.Status}}")),
+	})
+	var got error
+	r := httptest.NewRequest("POST", "https://app.example/auth/callback", nil)
+	r = r.WithContext(WithErrorHook(r.Context(), func(err error) { got = err }))
+	w := httptest.NewRecorder()
+	auth.Handler().ServeHTTP(w, r)
+	if got == nil {
+		t.Error("hook not called")
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "error page") {
+		t.Errorf("body: got %q, want the error template", body)
+	}
+}
+
+func TestConnectionParam(t *testing.T) {
+	srv, _ := newSigningProvider(t)
+	for _, tt := range []struct {
+		param string
+		ok    bool
+	}{
+		{"", true},
+		{"idp", true},
+		{"organization", true},
+		{"nonce", false},
+		{"prompt", false},
+		{"login_hint", false},
+		{"hd", false},
+		{"acr_values", false},
+		{"max_age", false},
+	} {
+		auth, err := New(context.Background(), &Config{
+			Provider:        srv.URL,
+			ClientID:        "client",
+			HTTPClient:      srv.Client(),
+			Mux:             http.NewServeMux(),
+			ConnectionParam: tt.param,
+		})
+		if err == nil {
+			auth.Close()
+		}
+		if got := err == nil; got != tt.ok {
+			t.Errorf("New(ConnectionParam %q): got error %v", tt.param, err)
+		}
+	}
+}
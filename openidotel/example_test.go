@@ -0,0 +1,30 @@
+package openidotel_test
+
+import (
+        "context"
+        "fmt"
+        "log"
+        "net/http"
+
+        "github.com/StalkR/openid"
+        "github.com/StalkR/openid/openidotel"
+)
+
+func ExampleNew() {
+        ctx := context.Background()
+        auth, err := openidotel.New(ctx, &openid.Config{
+                Provider: "https://accounts.google.com",
+                ClientID: "xxx.apps.googleusercontent.com",
+        })
+        if err != nil {
+                log.Fatal(err)
+        }
+        http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+                user, err := auth.User(r)
+                if err != nil {
+                        auth.Redirect(w, r)
+                        return
+                }
+                fmt.Fprintf(w, "Hello %v", user)
+        })
+}
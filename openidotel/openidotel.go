@@ -0,0 +1,270 @@
+/*
+Package openidotel instruments the openid packages with OpenTelemetry.
+
+It is a separate module so that the core packages do not depend on
+OpenTelemetry. Spans carry the provider, the outcome and the failure reason.
+
+Outbound requests of openid (discovery, keys) are traced with the client
+configured by New, and those of openid20 (check_authentication) by Verify. The
+callback handler registered by New is traced through the Mux of the config,
+with the reason of a failure from openid.WithErrorHook. Require and RequireAPI
+report the outcome but not the reason of a failure, which they do not expose;
+only the methods of Auth are traced, not those of the embedded openid.Auth.
+*/
+package openidotel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/StalkR/openid"
+	"github.com/StalkR/openid/openid20"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "github.com/StalkR/openid/openidotel"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Transport returns a RoundTripper tracing outbound requests.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// tracedClient returns a copy of client tracing its outbound requests.
+func tracedClient(client *http.Client) *http.Client {
+	c := *client
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.Transport = Transport(base)
+	return &c
+}
+
+// Auth wraps openid.Auth with spans around its methods.
+type Auth struct {
+	*openid.Auth
+	provider string
+}
+
+// New creates a new authentication module like openid.New, within a discovery
+// span, and with a traced HTTP client if none is configured.
+func New(ctx context.Context, config *openid.Config) (*Auth, error) {
+	ctx, span := tracer().Start(ctx, "openid.discovery", trace.WithAttributes(
+		attribute.String("openid.provider", config.Provider)))
+	defer span.End()
+	c := *config
+	if c.HTTPClient == nil {
+		c.HTTPClient = tracedClient(http.DefaultClient)
+	}
+	c.Mux = newCallbackMux(&c)
+	auth, err := openid.New(ctx, &c)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return &Auth{
+		Auth:     auth,
+		provider: config.Provider,
+	}, nil
+}
+
+// callbackMux traces the callback handler registered by openid.
+type callbackMux struct {
+	openid.Mux
+	callbackPath string
+	provider     string
+}
+
+func newCallbackMux(config *openid.Config) *callbackMux {
+	m := &callbackMux{
+		Mux:          config.Mux,
+		callbackPath: config.CallbackPath,
+		provider:     config.Provider,
+	}
+	if m.Mux == nil {
+		m.Mux = http.DefaultServeMux
+	}
+	if m.callbackPath == "" {
+		m.callbackPath = "/auth/callback"
+	}
+	return m
+}
+
+// Handle implements openid.Mux.
+func (m *callbackMux) Handle(pattern string, handler http.Handler) {
+	if pattern != m.callbackPath {
+		m.Mux.Handle(pattern, handler)
+		return
+	}
+	m.Mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer().Start(r.Context(), "openid.callback", trace.WithAttributes(
+			attribute.String("openid.provider", m.provider)))
+		defer span.End()
+		var err error
+		handler.ServeHTTP(w, r.WithContext(openid.WithErrorHook(ctx, func(e error) { err = e })))
+		end(span, err)
+	}))
+}
+
+// errUnauthenticated is the reason recorded when Require rejects a request.
+var errUnauthenticated = errors.New("unauthenticated")
+
+// Require is like openid.Auth.Require, within a verification span which ends
+// when next is called, with the context of the request and the user.
+func (s *Auth) Require(next http.Handler) http.Handler {
+	return s.traceRequire(s.Auth.Require, next)
+}
+
+// RequireAPI is like openid.Auth.RequireAPI, within a verification span which
+// ends when next is called.
+func (s *Auth) RequireAPI(next http.Handler) http.Handler {
+	return s.traceRequire(s.Auth.RequireAPI, next)
+}
+
+func (s *Auth) traceRequire(require func(http.Handler) http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent := trace.SpanFromContext(r.Context())
+		ctx, span := tracer().Start(r.Context(), "openid.verify", trace.WithAttributes(
+			attribute.String("openid.provider", s.provider)))
+		authenticated := false
+		require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authenticated = true
+			end(span, nil)
+			span.End()
+			// The spans of next are not children of the ended span, but of
+			// that of the request; the values set by require, e.g. the user
+			// for openid.UserFromContext, are kept.
+			next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(r.Context(), parent)))
+		})).ServeHTTP(w, r.WithContext(ctx))
+		if !authenticated {
+			end(span, errUnauthenticated)
+			span.End()
+		}
+	})
+}
+
+// Redirect redirects the user to the provider for authentication.
+func (s *Auth) Redirect(w http.ResponseWriter, r *http.Request) {
+	_, span := tracer().Start(r.Context(), "openid.redirect", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	s.Auth.Redirect(w, r)
+}
+
+// RedirectRemember is like Redirect with the choice of the user to be remembered.
+func (s *Auth) RedirectRemember(w http.ResponseWriter, r *http.Request, remember bool) {
+	_, span := tracer().Start(r.Context(), "openid.redirect", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	s.Auth.RedirectRemember(w, r, remember)
+}
+
+// RedirectWithConnection is like Redirect with a connection of the provider.
+func (s *Auth) RedirectWithConnection(w http.ResponseWriter, r *http.Request, connection string) {
+	_, span := tracer().Start(r.Context(), "openid.redirect", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	s.Auth.RedirectWithConnection(w, r, connection)
+}
+
+// RedirectHint is like Redirect with a login hint.
+func (s *Auth) RedirectHint(w http.ResponseWriter, r *http.Request, email string) {
+	_, span := tracer().Start(r.Context(), "openid.redirect", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	s.Auth.RedirectHint(w, r, email)
+}
+
+// RedirectWithPrompt is like Redirect with a prompt parameter.
+func (s *Auth) RedirectWithPrompt(w http.ResponseWriter, r *http.Request, prompt string) {
+	_, span := tracer().Start(r.Context(), "openid.redirect", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	s.Auth.RedirectWithPrompt(w, r, prompt)
+}
+
+// User returns the user email after verifying the id token cookie.
+func (s *Auth) User(r *http.Request) (string, error) {
+	id, err := s.Identity(r)
+	if err != nil {
+		return "", err
+	}
+	return id.Email, nil
+}
+
+// Identity returns the user identity after verifying the id token cookie.
+func (s *Auth) Identity(r *http.Request) (openid.Identity, error) {
+	ctx, span := tracer().Start(r.Context(), "openid.verify", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	id, err := s.Auth.Identity(r.WithContext(ctx))
+	end(span, err)
+	return id, err
+}
+
+// UserInfo returns the user after verifying the id token cookie.
+func (s *Auth) UserInfo(r *http.Request) (*openid.User, error) {
+	ctx, span := tracer().Start(r.Context(), "openid.verify", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	u, err := s.Auth.UserInfo(r.WithContext(ctx))
+	end(span, err)
+	return u, err
+}
+
+// Claims unmarshals all the claims of the token after verifying the id token cookie.
+func (s *Auth) Claims(r *http.Request, v interface{}) error {
+	ctx, span := tracer().Start(r.Context(), "openid.verify", trace.WithAttributes(
+		attribute.String("openid.provider", s.provider)))
+	defer span.End()
+	err := s.Auth.Claims(r.WithContext(ctx), v)
+	end(span, err)
+	return err
+}
+
+// Verify verifies an Open ID 2.0 return URL like openid20.Verify, tracing
+// check_authentication.
+func Verify(r *http.Request, endpoint string, allowed ...string) (string, error) {
+	return VerifyWith(r, &openid20.Verifier{Endpoint: endpoint, Allowed: allowed})
+}
+
+// VerifyWith verifies an Open ID 2.0 return URL with a verifier, tracing
+// check_authentication with its HTTP client or http.DefaultClient.
+func VerifyWith(r *http.Request, v *openid20.Verifier) (string, error) {
+	ctx, span := tracer().Start(r.Context(), "openid20.verify", trace.WithAttributes(
+		attribute.String("openid.provider", v.Endpoint)))
+	defer span.End()
+	traced := *v
+	client := http.DefaultClient
+	if v.HTTPClient != nil {
+		client = v.HTTPClient
+	}
+	traced.HTTPClient = tracedClient(client)
+	user, err := traced.Verify(r.WithContext(ctx))
+	end(span, err)
+	return user, err
+}
+
+// end records the outcome and reason of a verification on the span.
+func end(span trace.Span, err error) {
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.String("openid.outcome", "success"))
+	case errors.Is(err, openid.ErrNoSession):
+		span.SetAttributes(attribute.String("openid.outcome", "no_session"))
+	default:
+		span.SetAttributes(
+			attribute.String("openid.outcome", "failure"),
+			attribute.String("openid.reason", err.Error()))
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
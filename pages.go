@@ -0,0 +1,120 @@
+package openid
+
+import (
+	"context"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// CallbackData is the data of the callback page template.
+type CallbackData struct {
+	// CallbackPath is where the script must POST the fields.
+	CallbackPath string
+	// Fields are the names of the fragment parameters to POST.
+	Fields []string
+	// CSPNonce must be the nonce attribute of the script.
+	CSPNonce string
+	// NoFragmentURL is where to go without fragment, e.g. when the callback
+	// is bookmarked.
+	NoFragmentURL string
+}
+
+// ErrorData is the data of the error page template.
+type ErrorData struct {
+	Status  int
+	Message string
+}
+
+// callbackTemplate forwards the fragment of the callback to the server via POST.
+var callbackTemplate = template.Must(template.New("callback").Parse(`<html><body><script nonce="{{.CSPNonce}}">
+let hash = window.location.hash.substr(1);
+let fragments = hash.split('&').reduce((fragments, e) => {
+    let parts = e.split('=');
+    fragments[decodeURIComponent(parts[0])] = decodeURIComponent((parts[1] || '').replace(/\+/g, ' '));
+    return fragments;
+}, {});
+let fields = {{.Fields}}.filter(name => name in fragments);
+if (fields.length == 0) {
+    window.location.replace({{.NoFragmentURL}});
+} else {
+    let form = document.createElement('form');
+    form.method = 'POST';
+    form.action = {{.CallbackPath}};
+    for (let name of fields) {
+        let input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = name;
+        input.value = fragments[name];
+        form.appendChild(input);
+    }
+    document.body.appendChild(form);
+    form.submit();
+}
+</script></body></html>`))
+
+// callbackPage serves the page forwarding the fragment to the server.
+func (s *Auth) callbackPage(w http.ResponseWriter, r *http.Request) {
+	// Independent from the OAuth nonce, it allows the inline script under a strict CSP.
+	cspNonce := base64.StdEncoding.EncodeToString(randBytes(16))
+	if s.emitCSP {
+		w.Header().Set("Content-Security-Policy", "script-src 'nonce-"+cspNonce+"'")
+	}
+	data := &CallbackData{
+		CallbackPath:  s.callbackPath,
+		Fields:        []string{"id_token", "code", "state", "error", "error_description", "error_uri"},
+		CSPNonce:      cspNonce,
+		NoFragmentURL: s.noFragmentURL(),
+	}
+	if err := s.callbackTemplate.Execute(w, data); err != nil {
+		log.Printf("callback template: %v", err)
+	}
+}
+
+// noFragmentURL is where to go from the callback without parameters: login
+// again if possible.
+func (s *Auth) noFragmentURL() string {
+	if s.loginPath != "" {
+		return s.loginPath
+	}
+	return "/"
+}
+
+// ErrorHandler replies to an error with an HTTP status code.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// DefaultErrorHandler replies with the error in plain text, like http.Error.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+type errorHookKey struct{}
+
+// WithErrorHook returns a copy of ctx in which the errors replied by the
+// handlers of Auth, e.g. the callback, are also passed to hook, e.g. to record
+// them in a trace. The reply is unchanged, by ErrorHandler or ErrorTemplate.
+func WithErrorHook(ctx context.Context, hook func(error)) context.Context {
+	return context.WithValue(ctx, errorHookKey{}, hook)
+}
+
+// error replies with the error handler, else an error page, or plain text if
+// there is no template.
+func (s *Auth) error(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if hook, ok := r.Context().Value(errorHookKey{}).(func(error)); ok {
+		hook(err)
+	}
+	if s.errorHandler != nil {
+		s.errorHandler(w, r, status, err)
+		return
+	}
+	if s.errorTemplate == nil {
+		DefaultErrorHandler(w, r, status, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := s.errorTemplate.Execute(w, &ErrorData{Status: status, Message: err.Error()}); err != nil {
+		log.Printf("error template: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// profile holds the claims of the userinfo endpoint kept in the session, for
+// those missing in the ID token, see Config.FetchUserInfo.
+type profile struct {
+	Subject string `json:"sub"`
+	Name    string `json:"name,omitempty"`
+	Picture string `json:"picture,omitempty"`
+}
+
+// hasProfile returns whether the ID token has the name and picture claims.
+func (s *Auth) hasProfile(idToken *oidc.IDToken) bool {
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return false
+	}
+	name, _ := claims[s.nameClaim].(string)
+	picture, _ := claims["picture"].(string)
+	return name != "" && picture != ""
+}
+
+// fetchProfile gets the profile at the userinfo endpoint with the access token.
+func (s *Auth) fetchProfile(r *http.Request, token *oauth2.Token) (*profile, error) {
+	ctx := s.clientContext(r.Context())
+	if err := s.sem.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.sem.release()
+	info, err := s.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := info.Claims(&claims); err != nil {
+		return nil, err
+	}
+	p := &profile{Subject: info.Subject}
+	p.Name, _ = claims[s.nameClaim].(string)
+	p.Picture, _ = claims["picture"].(string)
+	return p, nil
+}
+
+// setProfile sets the signed profile cookie.
+func (s *Auth) setProfile(w http.ResponseWriter, p *profile, maxAge int) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	v := base64.RawURLEncoding.EncodeToString(b)
+	s.setCookie(w, s.profileCookie, v+"."+base64.RawURLEncoding.EncodeToString(s.mac("profile", v)), maxAge, s.tokenSameSite)
+}
+
+// profile returns the profile from the signed profile cookie if it is for the
+// subject, otherwise nil.
+func (s *Auth) profile(r *http.Request, subject string) *profile {
+	c, err := r.Cookie(s.profileCookie)
+	if err != nil {
+		return nil
+	}
+	v, sig, _ := strings.Cut(c.Value, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac("profile", v)) {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil
+	}
+	var p profile
+	if err := json.Unmarshal(b, &p); err != nil || p.Subject != subject {
+		return nil
+	}
+	return &p
+}
@@ -0,0 +1,144 @@
+package openid
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNoRefreshToken is returned by Refresh when there is no refresh token,
+// e.g. the provider did not issue one.
+var ErrNoRefreshToken = errors.New("no refresh token")
+
+// oauth2Config returns the OAuth 2.0 configuration of the code flow.
+func (s *Auth) oauth2Config(r *http.Request) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     s.clientID,
+		ClientSecret: s.clientSecret,
+		Endpoint:     s.provider.Endpoint(),
+		RedirectURL:  s.redirectURI(r),
+	}
+}
+
+// clientContext returns a context for oauth2 with the HTTP client.
+func (s *Auth) clientContext(ctx context.Context) context.Context {
+	if s.client == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, s.client)
+}
+
+// Refresh obtains a new ID token with the refresh token and updates the
+// session, e.g. when User returns ErrExpired. Require does it as needed.
+func (s *Auth) Refresh(w http.ResponseWriter, r *http.Request) error {
+	_, err := s.refresh(w, r)
+	return err
+}
+
+// refresh obtains a new ID token with the refresh token, updates the cookies
+// and returns the new session.
+func (s *Auth) refresh(w http.ResponseWriter, r *http.Request) (*verifiedSession, error) {
+	if !s.enableRefresh {
+		return nil, ErrNoRefreshToken
+	}
+	c, err := r.Cookie(s.refreshCookie)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoRefreshToken, err)
+	}
+	refreshToken, err := s.decrypt("refresh", c.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoRefreshToken, err)
+	}
+	ctx := s.clientContext(r.Context())
+	if err := s.sem.acquire(ctx); err != nil {
+		return nil, err
+	}
+	token, err := s.oauth2Config(r).TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	s.sem.release()
+	if err != nil {
+		return nil, fmt.Errorf("refresh: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("refresh: no id_token in token response")
+	}
+	const skipExpiry = false
+	idToken, id, err := s.verify(r.Context(), rawIDToken, skipExpiry)
+	if err != nil {
+		s.verifyFailed(r, err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if s.sessionStore != nil {
+		if err := s.checkSession(r, id); err != nil {
+			return nil, err
+		}
+	}
+	// The refreshed token must be for the same user.
+	if old, err := s.rawToken(r); err == nil {
+		if prev, _, err := s.verify(r.Context(), old, true); err == nil && prev.Subject != idToken.Subject {
+			return nil, fmt.Errorf("refresh: subject changed from %v to %v", prev.Subject, idToken.Subject)
+		}
+	}
+	maxAge := s.sessionMaxAge
+	if _, err := r.Cookie(s.sessionCookie); err == nil {
+		maxAge = 0
+	}
+	if err := s.setToken(w, r, rawIDToken, maxAge); err != nil {
+		return nil, err
+	}
+	// Providers may rotate refresh tokens.
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		s.setRefreshToken(w, token.RefreshToken, maxAge)
+	}
+	sess := &verifiedSession{token: rawIDToken, idToken: idToken, id: id}
+	if s.fetchUserInfo {
+		sess.profile = s.profile(r, idToken.Subject)
+	}
+	return sess, nil
+}
+
+// setRefreshToken stores the refresh token, encrypted, in a cookie.
+func (s *Auth) setRefreshToken(w http.ResponseWriter, refreshToken string, maxAge int) {
+	s.setCookie(w, s.refreshCookie, s.encrypt("refresh", refreshToken), maxAge, s.tokenSameSite)
+}
+
+// aead returns the cipher for a purpose, keyed with the secret.
+func (s *Auth) aead(purpose string) cipher.AEAD {
+	block, err := aes.NewCipher(s.mac(purpose, "key"))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (s *Auth) encrypt(purpose, plaintext string) string {
+	aead := s.aead(purpose)
+	nonce := randBytes(aead.NonceSize())
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func (s *Auth) decrypt(purpose, ciphertext string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	aead := s.aead(purpose)
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,199 @@
+package openid
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionInfo describes a login session, e.g. for users to review and revoke
+// their sessions.
+type SessionInfo struct {
+	ID   string
+	User string // email, for display
+	// Issuer and Subject identify the user the session is listed for.
+	Issuer    string
+	Subject   string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	UserAgent string
+	IP        string
+}
+
+// SessionStore records the login sessions, see Config.SessionStore.
+// It must be safe for concurrent use.
+type SessionStore interface {
+	// Save creates or updates a session.
+	Save(ctx context.Context, info *SessionInfo) error
+	// Get returns a session, or nil if it does not exist.
+	Get(ctx context.Context, id string) (*SessionInfo, error)
+	// List returns the sessions of a user, by issuer and subject.
+	List(ctx context.Context, issuer, subject string) ([]SessionInfo, error)
+	// Delete deletes a session, if it exists.
+	Delete(ctx context.Context, id string) error
+}
+
+// ErrSessionRevoked is returned when the session is not in the SessionStore,
+// e.g. after RevokeSession. It wraps ErrNoSession.
+var ErrSessionRevoked = fmt.Errorf("%w: session revoked", ErrNoSession)
+
+// errNoSessionStore is returned by the session methods without SessionStore.
+var errNoSessionStore = errors.New("no SessionStore")
+
+// lastSeenInterval limits how often the last seen time of a session is saved.
+const lastSeenInterval = time.Minute
+
+// Sessions returns the sessions of the user, with Config.SessionStore.
+// They are listed by issuer and subject, not by email which may be unverified
+// (AllowUnverifiedEmail) or reassigned.
+func (s *Auth) Sessions(ctx context.Context, id Identity) ([]SessionInfo, error) {
+	if s.sessionStore == nil {
+		return nil, errNoSessionStore
+	}
+	return s.sessionStore.List(ctx, id.Issuer, id.Subject)
+}
+
+// RevokeSession revokes a session, with Config.SessionStore: its token is no
+// longer accepted.
+func (s *Auth) RevokeSession(ctx context.Context, id string) error {
+	if s.sessionStore == nil {
+		return errNoSessionStore
+	}
+	return s.sessionStore.Delete(ctx, id)
+}
+
+// startSession records a new session after login and sets its cookie.
+func (s *Auth) startSession(w http.ResponseWriter, r *http.Request, id Identity, maxAge int) error {
+	now := s.now()
+	info := &SessionInfo{
+		ID:        hex.EncodeToString(randBytes(16)),
+		User:      id.Email,
+		Issuer:    id.Issuer,
+		Subject:   id.Subject,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(time.Duration(s.sessionMaxAge) * time.Second),
+		UserAgent: r.UserAgent(),
+		IP:        remoteIP(r),
+	}
+	if err := s.sessionStore.Save(r.Context(), info); err != nil {
+		return err
+	}
+	s.setCookie(w, s.sessionIDCookie, info.ID, maxAge, s.tokenSameSite)
+	return nil
+}
+
+// checkSession verifies the session of the request is still recorded for the
+// user, and updates its last seen time.
+func (s *Auth) checkSession(r *http.Request, id Identity) error {
+	c, err := r.Cookie(s.sessionIDCookie)
+	if err != nil {
+		return ErrSessionRevoked
+	}
+	info, err := s.sessionStore.Get(r.Context(), c.Value)
+	if err != nil {
+		return fmt.Errorf("session store: %v", err)
+	}
+	if info == nil || info.Issuer != id.Issuer || info.Subject != id.Subject {
+		return ErrSessionRevoked
+	}
+	if now := s.now(); now.Sub(info.LastSeen) > lastSeenInterval {
+		info.LastSeen = now
+		info.IP = remoteIP(r)
+		if s.slidingSession {
+			info.Expires = now.Add(time.Duration(s.sessionMaxAge) * time.Second)
+		}
+		if err := s.sessionStore.Save(r.Context(), info); err != nil {
+			return fmt.Errorf("session store: %v", err)
+		}
+	}
+	return nil
+}
+
+// endSession deletes the session of the request from the store, if any.
+func (s *Auth) endSession(r *http.Request) {
+	if s.sessionStore == nil {
+		return
+	}
+	if c, err := r.Cookie(s.sessionIDCookie); err == nil {
+		s.sessionStore.Delete(r.Context(), c.Value)
+	}
+}
+
+// MemorySessionStore is a SessionStore in memory, for a single server.
+// Sessions are dropped once expired.
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]SessionInfo
+	nextSweep time.Time
+}
+
+// NewMemorySessionStore creates a new in-memory session store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]SessionInfo{}}
+}
+
+// Save implements SessionStore.
+func (m *MemorySessionStore) Save(ctx context.Context, info *SessionInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	m.sessions[info.ID] = *info
+	return nil
+}
+
+// Get implements SessionStore.
+func (m *MemorySessionStore) Get(ctx context.Context, id string) (*SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.sessions[id]
+	if !ok || time.Now().After(info.Expires) {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// List implements SessionStore, most recently seen first.
+func (m *MemorySessionStore) List(ctx context.Context, issuer, subject string) ([]SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	now := time.Now()
+	var r []SessionInfo
+	for _, info := range m.sessions {
+		if info.Issuer == issuer && info.Subject == subject && !now.After(info.Expires) {
+			r = append(r, info)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].LastSeen.After(r[j].LastSeen) })
+	return r, nil
+}
+
+// Delete implements SessionStore.
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// sweep drops the expired sessions at most every sweepInterval, with the lock
+// held.
+func (m *MemorySessionStore) sweep() {
+	now := time.Now()
+	if now.Before(m.nextSweep) {
+		return
+	}
+	m.nextSweep = now.Add(sweepInterval)
+	for id, info := range m.sessions {
+		if now.After(info.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package openid
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{SessionStore: NewMemorySessionStore(), AllowUnverifiedEmail: true})
+	ctx := context.Background()
+	var victim Identity
+	for _, claims := range []map[string]interface{}{
+		{"sub": "victim"},
+		{"sub": "attacker", "email_verified": false},
+	} {
+		_, id, err := auth.verify(ctx, sign(claims), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := auth.startSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), id, 0); err != nil {
+			t.Fatal(err)
+		}
+		if id.Subject == "victim" {
+			victim = id
+		}
+	}
+	sessions, err := auth.Sessions(ctx, victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Subject != "victim" {
+		t.Fatalf("Sessions: got %+v, want only that of the victim", sessions)
+	}
+	if err := auth.RevokeSession(ctx, sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := auth.Sessions(ctx, victim); len(sessions) != 0 {
+		t.Errorf("Sessions after RevokeSession: got %+v, want none", sessions)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemorySessionStore()
+	m.Save(ctx, &SessionInfo{ID: "live", Subject: "sub", Expires: time.Now().Add(time.Hour)})
+	m.Save(ctx, &SessionInfo{ID: "expired", Subject: "sub", Expires: time.Now().Add(-time.Second)})
+	if got, _ := m.List(ctx, "", "sub"); len(got) != 1 || got[0].ID != "live" {
+		t.Errorf("List: got %+v, want only the live session", got)
+	}
+	if _, ok := m.sessions["expired"]; !ok {
+		t.Error("expired session swept before sweepInterval")
+	}
+	m.nextSweep = time.Time{}
+	m.List(ctx, "", "sub")
+	if _, ok := m.sessions["expired"]; ok {
+		t.Error("expired session not swept")
+	}
+}
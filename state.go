@@ -0,0 +1,53 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// loginState is carried through the login flow in a signed cookie.
+type loginState struct {
+	// Return is the local URL to return to after login.
+	Return string `json:"r,omitempty"`
+	// Forget makes the token cookie last only for the browser session.
+	Forget bool `json:"f,omitempty"`
+	// Verifier is the PKCE code verifier of the code flow.
+	Verifier string `json:"v,omitempty"`
+}
+
+// setState sets the signed state cookie, alongside the nonce cookie.
+func (s *Auth) setState(w http.ResponseWriter, st *loginState) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		panic(err)
+	}
+	p := base64.RawURLEncoding.EncodeToString(b)
+	const oneHour = 60 * 60
+	s.setCookie(w, s.stateCookie, p+"."+base64.RawURLEncoding.EncodeToString(s.mac("state", p)), oneHour, s.nonceSameSite)
+}
+
+// state returns the state from the signed state cookie, or an empty state
+// if it is missing or invalid.
+func (s *Auth) state(r *http.Request) *loginState {
+	st := &loginState{}
+	c, err := r.Cookie(s.stateCookie)
+	if err != nil {
+		return st
+	}
+	p, sig, _ := strings.Cut(c.Value, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac("state", p)) {
+		return st
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return st
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return &loginState{}
+	}
+	return st
+}
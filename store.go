@@ -0,0 +1,153 @@
+package openid
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Store keeps the ID tokens server-side, see Config.Store.
+// It must be safe for concurrent use.
+type Store interface {
+	// Save creates or replaces a token, which can be dropped after expiry.
+	Save(ctx context.Context, id, token string, expiry time.Time) error
+	// Load returns a token, or an empty string if it does not exist.
+	Load(ctx context.Context, id string) (string, error)
+	// Delete deletes a token, if it exists.
+	Delete(ctx context.Context, id string) error
+}
+
+// setToken sets the token cookie to the raw ID token, or with Config.Store to
+// a new opaque ID under which the token is stored, replacing the previous one.
+func (s *Auth) setToken(w http.ResponseWriter, r *http.Request, rawIDToken string, maxAge int) error {
+	if s.store == nil {
+		return s.setTokenCookie(w, r, rawIDToken, maxAge)
+	}
+	id := hex.EncodeToString(randBytes(16))
+	if err := s.store.Save(r.Context(), id, rawIDToken, s.storeExpiry()); err != nil {
+		return fmt.Errorf("token store: %v", err)
+	}
+	if old, err := s.tokenCookieValue(r); err == nil {
+		s.store.Delete(r.Context(), old)
+	}
+	return s.setTokenCookie(w, r, id, maxAge)
+}
+
+// storeExpiry returns the expiry of a token saved in Config.Store now, that of
+// the session.
+func (s *Auth) storeExpiry() time.Time {
+	return s.now().Add(time.Duration(s.sessionMaxAge) * time.Second)
+}
+
+// extendStoredToken extends the expiry of the token of the request in
+// Config.Store, if set, e.g. with Config.SlidingSession.
+func (s *Auth) extendStoredToken(r *http.Request) {
+	if s.store == nil {
+		return
+	}
+	id, err := s.tokenCookieValue(r)
+	if err != nil {
+		return
+	}
+	if token, err := s.rawToken(r); err == nil {
+		s.store.Save(r.Context(), id, token, s.storeExpiry())
+	}
+}
+
+// rawToken returns the raw ID token of the token cookie, loaded from
+// Config.Store if set. The error matches ErrNoSession if there is none.
+func (s *Auth) rawToken(r *http.Request) (string, error) {
+	v, err := s.tokenCookieValue(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNoSession, err)
+	}
+	if s.store == nil {
+		return v, nil
+	}
+	token, err := s.store.Load(r.Context(), v)
+	if err != nil {
+		return "", fmt.Errorf("token store: %v", err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("%w: token not in store", ErrNoSession)
+	}
+	return token, nil
+}
+
+// deleteToken deletes the token cookie, and the token from Config.Store if set.
+func (s *Auth) deleteToken(w http.ResponseWriter, r *http.Request) {
+	if s.store != nil {
+		if v, err := s.tokenCookieValue(r); err == nil {
+			s.store.Delete(r.Context(), v)
+		}
+	}
+	s.deleteTokenCookie(w)
+}
+
+// sweepInterval limits how often the memory stores drop their expired entries,
+// as it scans them all.
+const sweepInterval = time.Minute
+
+// MemoryStore is a Store in memory, for a single server.
+// Tokens are dropped once expired.
+type MemoryStore struct {
+	mu        sync.Mutex
+	tokens    map[string]storedToken
+	nextSweep time.Time
+}
+
+type storedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// NewMemoryStore creates a new in-memory token store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tokens: map[string]storedToken{}}
+}
+
+// Save implements Store.
+func (m *MemoryStore) Save(ctx context.Context, id, token string, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	m.tokens[id] = storedToken{token: token, expiry: expiry}
+	return nil
+}
+
+// Load implements Store.
+func (m *MemoryStore) Load(ctx context.Context, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || time.Now().After(t.expiry) {
+		return "", nil
+	}
+	return t.token, nil
+}
+
+// Delete implements Store.
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, id)
+	return nil
+}
+
+// sweep drops the expired tokens at most every sweepInterval, with the lock
+// held.
+func (m *MemoryStore) sweep() {
+	now := time.Now()
+	if now.Before(m.nextSweep) {
+		return
+	}
+	m.nextSweep = now.Add(sweepInterval)
+	for id, t := range m.tokens {
+		if now.After(t.expiry) {
+			delete(m.tokens, id)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package openid
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	m.Save(ctx, "live", "token", time.Now().Add(time.Hour))
+	m.Save(ctx, "expired", "token", time.Now().Add(-time.Second))
+	if got, err := m.Load(ctx, "live"); err != nil || got != "token" {
+		t.Errorf("Load(live): got %q, %v; want token", got, err)
+	}
+	if got, err := m.Load(ctx, "expired"); err != nil || got != "" {
+		t.Errorf("Load(expired): got %q, %v; want none", got, err)
+	}
+	m.Save(ctx, "other", "token", time.Now().Add(time.Hour))
+	if _, ok := m.tokens["expired"]; !ok {
+		t.Error("expired token swept before sweepInterval")
+	}
+	m.nextSweep = time.Time{}
+	m.Save(ctx, "other", "token", time.Now().Add(time.Hour))
+	if _, ok := m.tokens["expired"]; ok {
+		t.Error("expired token not swept")
+	}
+	m.Delete(ctx, "live")
+	if got, _ := m.Load(ctx, "live"); got != "" {
+		t.Errorf("Load after Delete: got %q, want none", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	store := NewMemoryStore()
+	auth := newTestAuth(t, srv, &Config{Store: store})
+	token := sign(nil)
+
+	w := httptest.NewRecorder()
+	if err := auth.setToken(w, httptest.NewRequest("GET", "/", nil), token, 0); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	c, err := r.Cookie(auth.tokenCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value == token || len(store.tokens) != 1 {
+		t.Fatalf("token cookie %q: want an opaque ID of the stored token", c.Value)
+	}
+	if got, err := auth.Token(r); err != nil || got != token {
+		t.Errorf("Token: got %q, %v; want the stored token", got, err)
+	}
+
+	auth.deleteToken(httptest.NewRecorder(), r)
+	if len(store.tokens) != 0 {
+		t.Error("token still stored after delete")
+	}
+	if _, err := auth.Token(r); !errors.Is(err, ErrNoSession) {
+		t.Errorf("Token after delete: got %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestStoreNotUsed(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{})
+	token := sign(nil)
+	w := httptest.NewRecorder()
+	if err := auth.setToken(w, httptest.NewRequest("GET", "/", nil), token, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == auth.tokenCookie && c.Value != token {
+			t.Errorf("token cookie: got %q, want the token", c.Value)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package openid
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/StalkR/openid/openid20"
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// signFunc signs a token for the client, with claims overriding the default
+// ones, or deleting them if nil.
+type signFunc func(claims map[string]interface{}) string
+
+// newSigningProvider serves a provider with a key, and returns a function to
+// sign tokens with it.
+func newSigningProvider(tb testing.TB) (*httptest.Server, signFunc) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	tb.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/auth",
+			"token_endpoint":                        srv.URL + "/token",
+			"jwks_uri":                              srv.URL + "/keys",
+			"response_types_supported":              []string{"code", "id_token"},
+			"id_token_signing_alg_values_supported": []string{"ES256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "key", Algorithm: "ES256", Use: "sig"},
+		}})
+	})
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "key"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sign := func(claims map[string]interface{}) string {
+		all := map[string]interface{}{
+			"iss":            srv.URL,
+			"aud":            "client",
+			"sub":            "123",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			if v == nil {
+				delete(all, k)
+			} else {
+				all[k] = v
+			}
+		}
+		payload, err := json.Marshal(all)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return token
+	}
+	return srv, sign
+}
+
+// newTestAuth creates an auth module with the provider, and its own mux.
+func newTestAuth(tb testing.TB, srv *httptest.Server, config *Config) *Auth {
+	config.Provider = srv.URL
+	if config.ClientID == "" {
+		config.ClientID = "client"
+	}
+	config.HTTPClient = srv.Client()
+	config.Mux = http.NewServeMux()
+	auth, err := New(context.Background(), config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { auth.Close() })
+	return auth
+}
+
+func TestVerify(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{ClockSkew: time.Minute})
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		claims  map[string]interface{}
+		wantErr error // nil for any error
+		ok      bool
+	}{
+		{name: "valid", ok: true},
+		{name: "expired", claims: map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}, wantErr: ErrExpired},
+		{name: "expired within skew", claims: map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, ok: true},
+		{name: "not yet valid", claims: map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}},
+		{name: "not yet valid within skew", claims: map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, ok: true},
+		{name: "valid since", claims: map[string]interface{}{"nbf": now.Add(-time.Hour).Unix()}, ok: true},
+		{name: "other audience", claims: map[string]interface{}{"aud": "other"}, wantErr: ErrAudienceMismatch},
+		{name: "other issuer", claims: map[string]interface{}{"iss": "https://other.example"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.VerifyToken(context.Background(), sign(tt.claims))
+			switch {
+			case tt.ok && err != nil:
+				t.Errorf("VerifyToken: %v", err)
+			case !tt.ok && err == nil:
+				t.Error("VerifyToken: got nil error")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("VerifyToken: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	srv, sign := newSigningProvider(t)
+	auth := newTestAuth(t, srv, &Config{ReplayStore: openid20.NewMemoryNonceStore()})
+	// Expired but accepted within the clock skew, so it must still be recorded.
+	token := sign(map[string]interface{}{"jti": "j1", "exp": time.Now().Add(-10 * time.Second).Unix()})
+	idToken, err := auth.VerifyToken(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.verifyReplay(context.Background(), idToken); err != nil {
+		t.Fatalf("verifyReplay: %v", err)
+	}
+	if err := auth.verifyReplay(context.Background(), idToken); err == nil {
+		t.Error("verifyReplay of a replayed token: got nil error")
+	}
+}
+
+func BenchmarkVerifyToken(b *testing.B) {
+	srv, sign := newSigningProvider(b)
+	auth := newTestAuth(b, srv, &Config{})
+	token := sign(nil)
+	ctx := context.Background()
+	if _, err := auth.VerifyToken(ctx, token); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := auth.VerifyToken(ctx, token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}